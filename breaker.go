@@ -0,0 +1,229 @@
+package go_app_push
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"sync"
+	"time"
+)
+
+type BreakerState int
+
+const (
+	BreakerClosed BreakerState = iota
+	BreakerOpen
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// BreakerConfig sets when a circuit opens. Only network errors, 5xx/429
+// statuses and transient or rate limited vendor codes count as failures.
+type BreakerConfig struct {
+	ConsecutiveFailures int                                     // open after this many failures in a row, 0 disables the check
+	FailureRate         float64                                 // open when the failure ratio in Window reaches it, 0 disables the check
+	MinRequests         int                                     // requests needed in Window before FailureRate applies, default 20
+	Window              time.Duration                           // default 1 minute
+	OpenTimeout         time.Duration                           // time spent open before probing, default 30s
+	HalfOpenRequests    int                                     // probes allowed while half-open, default 1
+	PerEndpoint         bool                                    // one circuit per endpoint instead of per host
+	OnStateChange       func(key string, from, to BreakerState) // called with the breaker locked
+}
+
+func (c BreakerConfig) enabled() bool {
+	return c.ConsecutiveFailures > 0 || c.FailureRate > 0
+}
+
+// CircuitBreaker keeps one circuit per vendor host, or per endpoint when
+// PerEndpoint is set.
+type CircuitBreaker struct {
+	cfg      BreakerConfig
+	mu       sync.Mutex
+	circuits map[string]*circuit
+}
+
+type circuit struct {
+	state       BreakerState
+	openedAt    time.Time
+	windowStart time.Time
+	requests    int
+	failures    int
+	consecutive int
+	probes      int
+}
+
+func NewCircuitBreaker(cfg BreakerConfig) *CircuitBreaker {
+	if cfg.MinRequests == 0 {
+		cfg.MinRequests = 20
+	}
+	if cfg.Window == 0 {
+		cfg.Window = time.Minute
+	}
+	if cfg.OpenTimeout == 0 {
+		cfg.OpenTimeout = 30 * time.Second
+	}
+	if cfg.HalfOpenRequests == 0 {
+		cfg.HalfOpenRequests = 1
+	}
+	return &CircuitBreaker{cfg: cfg, circuits: make(map[string]*circuit)}
+}
+
+// State returns the state of the circuit for key, a host or an endpoint.
+func (cb *CircuitBreaker) State(key string) BreakerState {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if c, ok := cb.circuits[key]; ok {
+		cb.expire(key, c, time.Now())
+		return c.state
+	}
+	return BreakerClosed
+}
+
+// States returns the state of every circuit used so far.
+func (cb *CircuitBreaker) States() map[string]BreakerState {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	now := time.Now()
+	states := make(map[string]BreakerState, len(cb.circuits))
+	for key, c := range cb.circuits {
+		cb.expire(key, c, now)
+		states[key] = c.state
+	}
+	return states
+}
+
+func (cb *CircuitBreaker) key(r *PushReq) string {
+	if cb == nil {
+		return ""
+	}
+	if cb.cfg.PerEndpoint {
+		return r.Endpoint
+	}
+	if u, err := url.Parse(r.Url); err == nil && len(u.Host) > 0 {
+		return u.Host
+	}
+	return r.Endpoint
+}
+
+// allow returns CircuitOpenErr when the request must not be sent.
+func (cb *CircuitBreaker) allow(key string) (err error) {
+	if cb == nil {
+		return
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	c, ok := cb.circuits[key]
+	if !ok {
+		c = &circuit{windowStart: time.Now()}
+		cb.circuits[key] = c
+	}
+	cb.expire(key, c, time.Now())
+	switch c.state {
+	case BreakerOpen:
+		err = CircuitOpenErr
+	case BreakerHalfOpen:
+		if c.probes >= cb.cfg.HalfOpenRequests {
+			err = CircuitOpenErr
+			return
+		}
+		c.probes++
+	}
+	return
+}
+
+// done records the outcome of a request let through by allow.
+func (cb *CircuitBreaker) done(ctx context.Context, key string, err error) {
+	if cb == nil {
+		return
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	c, ok := cb.circuits[key]
+	if !ok {
+		return
+	}
+	now := time.Now()
+	failed := breakerFailure(err)
+	if c.state == BreakerOpen {
+		return
+	}
+	// the caller gave up, which says nothing about the vendor
+	if ctx.Err() != nil {
+		if c.state == BreakerHalfOpen {
+			c.probes--
+		}
+		return
+	}
+	if c.state == BreakerHalfOpen {
+		if failed {
+			cb.open(key, c, now)
+		} else {
+			cb.setState(key, c, BreakerClosed)
+			c.reset(now)
+		}
+		return
+	}
+	if now.Sub(c.windowStart) > cb.cfg.Window {
+		c.windowStart, c.requests, c.failures = now, 0, 0
+	}
+	c.requests++
+	if !failed {
+		c.consecutive = 0
+		return
+	}
+	c.failures++
+	c.consecutive++
+	if cb.cfg.ConsecutiveFailures > 0 && c.consecutive >= cb.cfg.ConsecutiveFailures {
+		cb.open(key, c, now)
+		return
+	}
+	if cb.cfg.FailureRate > 0 && c.requests >= cb.cfg.MinRequests &&
+		float64(c.failures)/float64(c.requests) >= cb.cfg.FailureRate {
+		cb.open(key, c, now)
+	}
+}
+
+func (cb *CircuitBreaker) expire(key string, c *circuit, now time.Time) {
+	if c.state == BreakerOpen && now.Sub(c.openedAt) >= cb.cfg.OpenTimeout {
+		cb.setState(key, c, BreakerHalfOpen)
+		c.probes = 0
+	}
+}
+
+func (cb *CircuitBreaker) open(key string, c *circuit, now time.Time) {
+	cb.setState(key, c, BreakerOpen)
+	c.reset(now)
+	c.openedAt = now
+}
+
+func (cb *CircuitBreaker) setState(key string, c *circuit, state BreakerState) {
+	if c.state == state {
+		return
+	}
+	from := c.state
+	c.state = state
+	if cb.cfg.OnStateChange != nil {
+		cb.cfg.OnStateChange(key, from, state)
+	}
+}
+
+func (c *circuit) reset(now time.Time) {
+	c.windowStart = now
+	c.requests, c.failures, c.consecutive, c.probes = 0, 0, 0, 0
+}
+
+// breakerFailure counts retryable failures, client and transport timeouts
+// included as they are transient PushErrors.
+func breakerFailure(err error) bool {
+	var pe *PushError
+	return errors.As(err, &pe) && pe.Retryable()
+}
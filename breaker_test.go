@@ -0,0 +1,56 @@
+package go_app_push
+
+import (
+	"context"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestBreakerIgnoresCallerDeadline(t *testing.T) {
+	srv := newSlowServer(300 * time.Millisecond)
+	defer srv.Close()
+	client, err := NewAppPushWithConfig(Config{
+		Provider:   PlatformXIAOMI,
+		AppPkgName: "p",
+		XiaoMi:     XiaoMiConfig{AppSecret: "s", BaseURL: srv.URL},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cb := NewCircuitBreaker(BreakerConfig{ConsecutiveFailures: 1})
+	client.SetCircuitBreaker(cb)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err = client.PushWithContext(ctx, "t", "b", nil, []string{"a"}); err == nil {
+		t.Fatal("want deadline error")
+	}
+	u, _ := url.Parse(srv.URL)
+	if state := cb.State(u.Host); state != BreakerClosed {
+		t.Errorf("state = %v, want closed", state)
+	}
+}
+
+func TestBreakerCountsClientTimeout(t *testing.T) {
+	srv := newSlowServer(300 * time.Millisecond)
+	defer srv.Close()
+	client, err := NewAppPushWithConfig(Config{
+		Provider:   PlatformXIAOMI,
+		AppPkgName: "p",
+		XiaoMi:     XiaoMiConfig{AppSecret: "s", BaseURL: srv.URL},
+		HTTP:       HTTPOptions{Timeout: 50 * time.Millisecond},
+		Retry:      RetryPolicy{MaxAttempts: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cb := NewCircuitBreaker(BreakerConfig{ConsecutiveFailures: 1})
+	client.SetCircuitBreaker(cb)
+	if _, err = client.Push("t", "b", nil, []string{"a"}); err == nil {
+		t.Fatal("want timeout")
+	}
+	u, _ := url.Parse(srv.URL)
+	if state := cb.State(u.Host); state != BreakerOpen {
+		t.Errorf("state = %v, want open", state)
+	}
+}
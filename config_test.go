@@ -0,0 +1,17 @@
+package go_app_push
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestOPPOPushTypeValidated(t *testing.T) {
+	for _, pushType := range []OPPOPushType{OPPOPushTypeNil, 7} {
+		cfg := Config{Provider: PlatformOPPO, OPPO: OPPOConfig{AppKey: "k", MasterKey: "m", PushType: pushType}}
+		_, err := NewAppPushWithConfig(cfg)
+		var ce *ConfigError
+		if !errors.As(err, &ce) || ce.Field != "oppo.push_type" || !errors.Is(err, OPPOMissingPushTypeErr) {
+			t.Errorf("push type %d: got %v", pushType, err)
+		}
+	}
+}
@@ -0,0 +1,484 @@
+package go_app_push
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultConfigEnvPrefix prefixes the environment variables read by
+// ConfigSource.
+const DefaultConfigEnvPrefix = "APP_PUSH_"
+
+// ConfigFile is the layout of a YAML or JSON config file. Names such as the
+// provider are case insensitive, durations use time.ParseDuration, e.g. "10s".
+// Every key can be overridden by an environment variable named after its
+// path, e.g. APP_PUSH_HUAWEI_CLIENT_SECRET for huawei.client_secret, except
+// rate_limit.endpoints. Empty values leave the setting unchanged.
+type ConfigFile struct {
+	Provider   string `yaml:"provider" json:"provider"` // huawei, oppo, vivo, xiaomi or meizu
+	Device     string `yaml:"device" json:"device"`     // android or ios
+	AppPkgName string `yaml:"app_pkg_name" json:"app_pkg_name"`
+	HuaWei     struct {
+		ClientId     string       `yaml:"client_id" json:"client_id"`
+		ClientSecret string       `yaml:"client_secret" json:"client_secret"`
+		AuthBaseURL  string       `yaml:"auth_base_url" json:"auth_base_url"`
+		BaseURL      string       `yaml:"base_url" json:"base_url"`
+		Egress       EgressConfig `yaml:"egress" json:"egress"`
+	} `yaml:"huawei" json:"huawei"`
+	XiaoMi struct {
+		AppSecret string       `yaml:"app_secret" json:"app_secret"`
+		Env       string       `yaml:"env" json:"env"` // production or sandbox
+		BaseURL   string       `yaml:"base_url" json:"base_url"`
+		Egress    EgressConfig `yaml:"egress" json:"egress"`
+	} `yaml:"xiaomi" json:"xiaomi"`
+	OPPO struct {
+		AppKey    string       `yaml:"app_key" json:"app_key"`
+		MasterKey string       `yaml:"master_key" json:"master_key"`
+		PushType  string       `yaml:"push_type" json:"push_type"` // all, registration_id or alias
+		BaseURL   string       `yaml:"base_url" json:"base_url"`
+		Egress    EgressConfig `yaml:"egress" json:"egress"`
+	} `yaml:"oppo" json:"oppo"`
+	VIVO struct {
+		AppId     int          `yaml:"app_id" json:"app_id"`
+		AppKey    string       `yaml:"app_key" json:"app_key"`
+		AppSecret string       `yaml:"app_secret" json:"app_secret"`
+		BaseURL   string       `yaml:"base_url" json:"base_url"`
+		Egress    EgressConfig `yaml:"egress" json:"egress"`
+	} `yaml:"vivo" json:"vivo"`
+	MeiZu struct {
+		AppId   int          `yaml:"app_id" json:"app_id"`
+		AppKey  string       `yaml:"app_key" json:"app_key"`
+		BaseURL string       `yaml:"base_url" json:"base_url"`
+		Egress  EgressConfig `yaml:"egress" json:"egress"`
+	} `yaml:"meizu" json:"meizu"`
+	HTTP struct {
+		Timeout             string `yaml:"timeout" json:"timeout"`
+		DialTimeout         string `yaml:"dial_timeout" json:"dial_timeout"`
+		TLSHandshakeTimeout string `yaml:"tls_handshake_timeout" json:"tls_handshake_timeout"`
+		IdleConnTimeout     string `yaml:"idle_conn_timeout" json:"idle_conn_timeout"`
+		MaxIdleConns        int    `yaml:"max_idle_conns" json:"max_idle_conns"`
+		MaxIdleConnsPerHost int    `yaml:"max_idle_conns_per_host" json:"max_idle_conns_per_host"`
+		MaxConnsPerHost     int    `yaml:"max_conns_per_host" json:"max_conns_per_host"`
+		ProxyURL            string `yaml:"proxy_url" json:"proxy_url"`
+		DisableHTTP2        bool   `yaml:"disable_http2" json:"disable_http2"`
+		InsecureSkipVerify  bool   `yaml:"insecure_skip_verify" json:"insecure_skip_verify"`
+	} `yaml:"http" json:"http"`
+	Retry struct {
+		MaxAttempts int    `yaml:"max_attempts" json:"max_attempts"`
+		BaseDelay   string `yaml:"base_delay" json:"base_delay"`
+		MaxDelay    string `yaml:"max_delay" json:"max_delay"`
+	} `yaml:"retry" json:"retry"`
+	RateLimit struct {
+		Policy    string              `yaml:"policy" json:"policy"` // wait or fail_fast
+		QPS       float64             `yaml:"qps" json:"qps"`
+		Burst     int                 `yaml:"burst" json:"burst"`
+		Endpoints map[string]RateFile `yaml:"endpoints" json:"endpoints"` // keyed by EndpointKind.String()
+	} `yaml:"rate_limit" json:"rate_limit"`
+	Breaker struct {
+		ConsecutiveFailures int     `yaml:"consecutive_failures" json:"consecutive_failures"`
+		FailureRate         float64 `yaml:"failure_rate" json:"failure_rate"`
+		MinRequests         int     `yaml:"min_requests" json:"min_requests"`
+		Window              string  `yaml:"window" json:"window"`
+		OpenTimeout         string  `yaml:"open_timeout" json:"open_timeout"`
+		HalfOpenRequests    int     `yaml:"half_open_requests" json:"half_open_requests"`
+		PerEndpoint         bool    `yaml:"per_endpoint" json:"per_endpoint"`
+	} `yaml:"breaker" json:"breaker"`
+}
+
+type RateFile struct {
+	QPS   float64 `yaml:"qps" json:"qps"`
+	Burst int     `yaml:"burst" json:"burst"`
+}
+
+// ConfigSource loads a Config from an optional file overlaid with the
+// environment. Settings that only exist in code, like the Logger, Metrics or
+// TokenStore, are taken from Base.
+type ConfigSource struct {
+	Path      string // .json is read as JSON, anything else as YAML
+	EnvPrefix string // default DefaultConfigEnvPrefix
+	Base      Config
+}
+
+// LoadConfig reads path and the APP_PUSH_ environment variables and
+// validates the result.
+func LoadConfig(path string) (cfg Config, err error) {
+	return ConfigSource{Path: path}.Load()
+}
+
+// Load reads and validates the Config. Errors name the bad setting with a
+// *ConfigError where the setting is known.
+func (s ConfigSource) Load() (cfg Config, err error) {
+	data, err := s.read()
+	if err != nil {
+		return
+	}
+	return s.load(data, s.environ())
+}
+
+func (s ConfigSource) load(data []byte, env map[string]string) (cfg Config, err error) {
+	var f ConfigFile
+	if len(data) > 0 {
+		if strings.EqualFold(filepath.Ext(s.Path), ".json") {
+			d := json.NewDecoder(bytes.NewReader(data))
+			d.DisallowUnknownFields()
+			err = d.Decode(&f)
+		} else {
+			d := yaml.NewDecoder(bytes.NewReader(data))
+			d.KnownFields(true)
+			if err = d.Decode(&f); err == io.EOF {
+				err = nil // only comments
+			}
+		}
+		if err != nil {
+			err = fmt.Errorf("%w: %s: %v", InvalidConfigValueErr, s.Path, err)
+			return
+		}
+	}
+	if err = f.setEnv(s.envPrefix(), env); err != nil {
+		return
+	}
+	cfg = s.Base
+	if err = f.apply(&cfg); err != nil {
+		return
+	}
+	err = cfg.Validate()
+	return
+}
+
+func (s ConfigSource) envPrefix() string {
+	if len(s.EnvPrefix) == 0 {
+		return DefaultConfigEnvPrefix
+	}
+	return s.EnvPrefix
+}
+
+func (s ConfigSource) read() (data []byte, err error) {
+	if len(s.Path) == 0 {
+		return
+	}
+	return ioutil.ReadFile(s.Path)
+}
+
+func (s ConfigSource) environ() map[string]string {
+	env := make(map[string]string)
+	prefix := s.envPrefix()
+	for _, kv := range os.Environ() {
+		if k, v, ok := strings.Cut(kv, "="); ok && strings.HasPrefix(k, prefix) {
+			env[k] = v
+		}
+	}
+	return env
+}
+
+// Watch checks the file, the environment and the egress certificate and key
+// files every interval until ctx is done, and passes every changed Config
+// that loads and validates to apply, e.g. AppPush.Reload. Changes made before
+// Watch is called are not seen.
+// Failures are logged to Base.Logger and the previous Config stays in use.
+func (s ConfigSource) Watch(ctx context.Context, interval time.Duration, apply func(Config) error) error {
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+	_, _, last, _ := s.snapshot()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+		data, env, fp, err := s.snapshot()
+		if err != nil {
+			logTo(s.Base.Logger, ctx, LogLevelWarn, "read config failed", F("path", s.Path), F("err", err))
+			continue
+		}
+		if fp == last {
+			continue
+		}
+		last = fp
+		cfg, err := s.load(data, env)
+		if err == nil {
+			err = apply(cfg)
+		}
+		if err != nil {
+			logTo(s.Base.Logger, ctx, LogLevelWarn, "reload config failed", F("path", s.Path), F("err", err))
+			continue
+		}
+		logTo(s.Base.Logger, ctx, LogLevelInfo, "config reloaded", F("path", s.Path), F("provider", cfg.Provider.String()))
+	}
+}
+
+func (s ConfigSource) snapshot() (data []byte, env map[string]string, fp string, err error) {
+	if data, err = s.read(); err != nil {
+		return
+	}
+	env = s.environ()
+	keys := make([]string, 0, len(env))
+	for k := range env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	b.Write(data)
+	for _, k := range keys {
+		b.WriteString("\x00" + k + "=" + env[k])
+	}
+	// certificates and keys are read when the client is built, a rotation
+	// has to trigger a reload as well
+	if cfg, e := s.load(data, env); e == nil {
+		for _, path := range cfg.egressFiles() {
+			pem, e := ioutil.ReadFile(path)
+			if e != nil {
+				pem = []byte(e.Error())
+			}
+			b.WriteString("\x00" + path + "\x00")
+			b.Write(pem)
+		}
+	}
+	fp = b.String()
+	return
+}
+
+// setEnv overrides the fields of f with the environment variables named
+// after their yaml keys.
+func (f *ConfigFile) setEnv(prefix string, env map[string]string) error {
+	return setEnvFields(reflect.ValueOf(f).Elem(), prefix, "", env)
+}
+
+func setEnvFields(v reflect.Value, prefix, path string, env map[string]string) (err error) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		key := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+		if len(path) > 0 {
+			key = path + "." + key
+		}
+		field := v.Field(i)
+		if field.Kind() == reflect.Struct {
+			if err = setEnvFields(field, prefix, key, env); err != nil {
+				return
+			}
+			continue
+		}
+		name := prefix + strings.ToUpper(strings.Replace(key, ".", "_", -1))
+		value, ok := env[name]
+		if !ok || len(value) == 0 {
+			continue
+		}
+		var e error
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(value)
+		case reflect.Int:
+			var n int64
+			n, e = strconv.ParseInt(value, 10, 0)
+			field.SetInt(n)
+		case reflect.Float64:
+			var n float64
+			n, e = strconv.ParseFloat(value, 64)
+			field.SetFloat(n)
+		case reflect.Bool:
+			var b bool
+			b, e = strconv.ParseBool(value)
+			field.SetBool(b)
+		default:
+			continue
+		}
+		if e != nil {
+			err = configErr(key, fmt.Errorf("%w: %s=%q", InvalidConfigValueErr, name, value))
+			return
+		}
+	}
+	return
+}
+
+// apply copies the settings present in f onto cfg.
+func (f *ConfigFile) apply(cfg *Config) (err error) {
+	s := &configSetter{}
+	if len(f.Provider) > 0 {
+		provider, e := ParsePlatformType(f.Provider)
+		s.check("provider", e)
+		cfg.Provider = provider
+	}
+	if len(f.Device) > 0 {
+		device, e := ParseDeviceType(f.Device)
+		s.check("device", e)
+		cfg.Device = device
+	}
+	s.string(&cfg.AppPkgName, f.AppPkgName)
+
+	s.string(&cfg.HuaWei.ClientId, f.HuaWei.ClientId)
+	s.string(&cfg.HuaWei.ClientSecret, f.HuaWei.ClientSecret)
+	s.string(&cfg.HuaWei.AuthBaseURL, f.HuaWei.AuthBaseURL)
+	s.string(&cfg.HuaWei.BaseURL, f.HuaWei.BaseURL)
+	s.egress(&cfg.HuaWei.Egress, f.HuaWei.Egress)
+
+	s.string(&cfg.XiaoMi.AppSecret, f.XiaoMi.AppSecret)
+	switch strings.ToLower(f.XiaoMi.Env) {
+	case "":
+	case "production":
+		cfg.XiaoMi.Env = XMEnvProduction
+	case "sandbox":
+		cfg.XiaoMi.Env = XMEnvSandbox
+	default:
+		s.invalid("xiaomi.env", f.XiaoMi.Env)
+	}
+	s.string(&cfg.XiaoMi.BaseURL, f.XiaoMi.BaseURL)
+	s.egress(&cfg.XiaoMi.Egress, f.XiaoMi.Egress)
+
+	s.string(&cfg.OPPO.AppKey, f.OPPO.AppKey)
+	s.string(&cfg.OPPO.MasterKey, f.OPPO.MasterKey)
+	switch strings.ToLower(f.OPPO.PushType) {
+	case "":
+	case "all":
+		cfg.OPPO.PushType = OPPOPushTypeAll
+	case "registration_id":
+		cfg.OPPO.PushType = OPPOPushTypeRegistrationId
+	case "alias":
+		cfg.OPPO.PushType = OPPOPushTypeAlias
+	default:
+		s.invalid("oppo.push_type", f.OPPO.PushType)
+	}
+	s.string(&cfg.OPPO.BaseURL, f.OPPO.BaseURL)
+	s.egress(&cfg.OPPO.Egress, f.OPPO.Egress)
+
+	s.int(&cfg.VIVO.AppId, f.VIVO.AppId)
+	s.string(&cfg.VIVO.AppKey, f.VIVO.AppKey)
+	s.string(&cfg.VIVO.AppSecret, f.VIVO.AppSecret)
+	s.string(&cfg.VIVO.BaseURL, f.VIVO.BaseURL)
+	s.egress(&cfg.VIVO.Egress, f.VIVO.Egress)
+
+	s.int(&cfg.MeiZu.AppId, f.MeiZu.AppId)
+	s.string(&cfg.MeiZu.AppKey, f.MeiZu.AppKey)
+	s.string(&cfg.MeiZu.BaseURL, f.MeiZu.BaseURL)
+	s.egress(&cfg.MeiZu.Egress, f.MeiZu.Egress)
+
+	s.duration(&cfg.HTTP.Timeout, "http.timeout", f.HTTP.Timeout)
+	s.duration(&cfg.HTTP.DialTimeout, "http.dial_timeout", f.HTTP.DialTimeout)
+	s.duration(&cfg.HTTP.TLSHandshakeTimeout, "http.tls_handshake_timeout", f.HTTP.TLSHandshakeTimeout)
+	s.duration(&cfg.HTTP.IdleConnTimeout, "http.idle_conn_timeout", f.HTTP.IdleConnTimeout)
+	s.int(&cfg.HTTP.MaxIdleConns, f.HTTP.MaxIdleConns)
+	s.int(&cfg.HTTP.MaxIdleConnsPerHost, f.HTTP.MaxIdleConnsPerHost)
+	s.int(&cfg.HTTP.MaxConnsPerHost, f.HTTP.MaxConnsPerHost)
+	s.string(&cfg.HTTP.ProxyURL, f.HTTP.ProxyURL)
+	s.bool(&cfg.HTTP.DisableHTTP2, f.HTTP.DisableHTTP2)
+	s.bool(&cfg.HTTP.InsecureSkipVerify, f.HTTP.InsecureSkipVerify)
+
+	s.int(&cfg.Retry.MaxAttempts, f.Retry.MaxAttempts)
+	s.duration(&cfg.Retry.BaseDelay, "retry.base_delay", f.Retry.BaseDelay)
+	s.duration(&cfg.Retry.MaxDelay, "retry.max_delay", f.Retry.MaxDelay)
+
+	switch strings.ToLower(f.RateLimit.Policy) {
+	case "":
+	case "wait":
+		cfg.RateLimit.Policy = RateLimitWait
+	case "fail_fast":
+		cfg.RateLimit.Policy = RateLimitFailFast
+	default:
+		s.invalid("rate_limit.policy", f.RateLimit.Policy)
+	}
+	s.float(&cfg.RateLimit.Default.QPS, f.RateLimit.QPS)
+	s.int(&cfg.RateLimit.Default.Burst, f.RateLimit.Burst)
+	if len(f.RateLimit.Endpoints) > 0 {
+		endpoints := make(map[EndpointKind]Rate, len(f.RateLimit.Endpoints))
+		for kind, rate := range cfg.RateLimit.Endpoints {
+			endpoints[kind] = rate
+		}
+		for name, rate := range f.RateLimit.Endpoints {
+			kind, ok := endpointKindNames[strings.ToLower(name)]
+			if !ok {
+				s.invalid("rate_limit.endpoints", name)
+				continue
+			}
+			endpoints[kind] = Rate{QPS: rate.QPS, Burst: rate.Burst}
+		}
+		cfg.RateLimit.Endpoints = endpoints
+	}
+
+	s.int(&cfg.Breaker.ConsecutiveFailures, f.Breaker.ConsecutiveFailures)
+	s.float(&cfg.Breaker.FailureRate, f.Breaker.FailureRate)
+	s.int(&cfg.Breaker.MinRequests, f.Breaker.MinRequests)
+	s.duration(&cfg.Breaker.Window, "breaker.window", f.Breaker.Window)
+	s.duration(&cfg.Breaker.OpenTimeout, "breaker.open_timeout", f.Breaker.OpenTimeout)
+	s.int(&cfg.Breaker.HalfOpenRequests, f.Breaker.HalfOpenRequests)
+	s.bool(&cfg.Breaker.PerEndpoint, f.Breaker.PerEndpoint)
+	return s.err
+}
+
+var endpointKindNames = map[string]EndpointKind{
+	EndpointAuth.String():         EndpointAuth,
+	EndpointSave.String():         EndpointSave,
+	EndpointUniCast.String():      EndpointUniCast,
+	EndpointUniBatchCast.String(): EndpointUniBatchCast,
+	EndpointBroadCast.String():    EndpointBroadCast,
+}
+
+// configSetter copies non-zero values and keeps the first error.
+type configSetter struct {
+	err error
+}
+
+func (s *configSetter) check(field string, err error) {
+	if s.err == nil {
+		s.err = configErr(field, err)
+	}
+}
+
+func (s *configSetter) invalid(field, value string) {
+	s.check(field, fmt.Errorf("%w: %q", InvalidConfigValueErr, value))
+}
+
+func (s *configSetter) string(dst *string, v string) {
+	if len(v) > 0 {
+		*dst = v
+	}
+}
+
+func (s *configSetter) int(dst *int, v int) {
+	if v != 0 {
+		*dst = v
+	}
+}
+
+func (s *configSetter) float(dst *float64, v float64) {
+	if v != 0 {
+		*dst = v
+	}
+}
+
+func (s *configSetter) bool(dst *bool, v bool) {
+	if v {
+		*dst = v
+	}
+}
+
+func (s *configSetter) egress(dst *EgressConfig, v EgressConfig) {
+	s.string(&dst.ProxyURL, v.ProxyURL)
+	s.string(&dst.RootCAFile, v.RootCAFile)
+	s.string(&dst.ClientCertFile, v.ClientCertFile)
+	s.string(&dst.ClientKeyFile, v.ClientKeyFile)
+}
+
+func (s *configSetter) duration(dst *time.Duration, field, v string) {
+	if len(v) == 0 {
+		return
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		s.invalid(field, v)
+		return
+	}
+	*dst = d
+}
@@ -0,0 +1,94 @@
+package go_app_push
+
+import (
+	"bytes"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCA writes a bundle of n copies of the httptest certificate.
+func writeCA(t *testing.T, path string, n int) {
+	srv := httptest.NewTLSServer(nil)
+	defer srv.Close()
+	data := bytes.Repeat(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), n)
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// A rotated certificate changes the fingerprint while the config file does not.
+func TestSnapshotCoversEgressFiles(t *testing.T) {
+	dir := t.TempDir()
+	ca := filepath.Join(dir, "ca.pem")
+	writeCA(t, ca, 1)
+	path := filepath.Join(dir, "push.yaml")
+	data := "provider: xiaomi\napp_pkg_name: p\nxiaomi:\n  app_secret: s\n  egress:\n    root_ca_file: " + ca + "\n"
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	s := ConfigSource{Path: path, EnvPrefix: "APP_PUSH_TEST_"}
+	_, _, before, err := s.snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeCA(t, ca, 2)
+	_, _, after, err := s.snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before == after {
+		t.Error("fingerprint unchanged after the root CA was replaced")
+	}
+}
+
+func TestEnvOverridesConfigFile(t *testing.T) {
+	data := []byte("provider: vivo\nvivo:\n  app_id: 1\n  app_key: k\n  app_secret: s\nretry:\n  max_attempts: 2\n")
+	env := map[string]string{
+		"APP_PUSH_VIVO_APP_SECRET":      "env-secret",
+		"APP_PUSH_VIVO_APP_KEY":         "", // empty keeps the file value
+		"APP_PUSH_RETRY_MAX_ATTEMPTS":   "4",
+		"APP_PUSH_RATE_LIMIT_QPS":       "2.5",
+		"APP_PUSH_HTTP_DISABLE_HTTP2":   "true",
+		"APP_PUSH_HTTP_TIMEOUT":         "3s",
+		"OTHER_PUSH_VIVO_APP_SECRET":    "other",
+		"APP_PUSH_HUAWEI_CLIENT_SECRET": "unused",
+	}
+	cfg, err := ConfigSource{Path: "push.yaml"}.load(data, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.VIVO.AppSecret != "env-secret" || cfg.VIVO.AppKey != "k" || cfg.VIVO.AppId != 1 {
+		t.Errorf("vivo = %+v", cfg.VIVO)
+	}
+	if cfg.Retry.MaxAttempts != 4 || cfg.RateLimit.Default.QPS != 2.5 || !cfg.HTTP.DisableHTTP2 || cfg.HTTP.Timeout != 3*time.Second {
+		t.Errorf("retry %+v, rate %+v, http %+v", cfg.Retry, cfg.RateLimit.Default, cfg.HTTP)
+	}
+	_, err = ConfigSource{Path: "push.yaml"}.load(data, map[string]string{"APP_PUSH_VIVO_APP_ID": "one"})
+	var ce *ConfigError
+	if !errors.As(err, &ce) || ce.Field != "vivo.app_id" || !errors.Is(err, InvalidConfigValueErr) {
+		t.Errorf("err = %v, want a vivo.app_id ConfigError", err)
+	}
+}
+
+func TestLoadConfigFromEnv(t *testing.T) {
+	t.Setenv("APP_PUSH_TEST_PROVIDER", "OPPO")
+	t.Setenv("APP_PUSH_TEST_OPPO_APP_KEY", "k")
+	t.Setenv("APP_PUSH_TEST_OPPO_MASTER_KEY", "m")
+	s := ConfigSource{EnvPrefix: "APP_PUSH_TEST_"}
+	if _, err := s.Load(); !errors.Is(err, OPPOMissingPushTypeErr) {
+		t.Fatalf("err = %v, want OPPOMissingPushTypeErr", err)
+	}
+	t.Setenv("APP_PUSH_TEST_OPPO_PUSH_TYPE", "alias")
+	cfg, err := s.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Provider != PlatformOPPO || cfg.OPPO.MasterKey != "m" || cfg.OPPO.PushType != OPPOPushTypeAlias {
+		t.Errorf("cfg = %v %+v", cfg.Provider, cfg.OPPO)
+	}
+}
@@ -0,0 +1,114 @@
+package go_app_push
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Target is a device token tagged with the vendor that issued it.
+type Target struct {
+	Platform PlatformType
+	Token    string
+}
+
+// Dispatcher holds one client per vendor and fans a message out to a mixed
+// list of targets.
+type Dispatcher struct {
+	mu      sync.RWMutex
+	clients map[PlatformType]*AppPush
+}
+
+type DispatchResult struct {
+	Results map[PlatformType]*PushResult
+	Errors  map[PlatformType]error
+}
+
+func NewDispatcher(clients ...*AppPush) *Dispatcher {
+	d := &Dispatcher{clients: make(map[PlatformType]*AppPush)}
+	for _, client := range clients {
+		d.Register(client)
+	}
+	return d
+}
+
+func NewDispatcherWithConfig(cfgs ...Config) (d *Dispatcher, err error) {
+	d = NewDispatcher()
+	for _, cfg := range cfgs {
+		var client *AppPush
+		client, err = NewAppPushWithConfig(cfg)
+		if err != nil {
+			err = fmt.Errorf("%s: %w", cfg.Provider, err)
+			return
+		}
+		d.Register(client)
+	}
+	return
+}
+
+// Register adds the client for its provider, replacing any previous one.
+func (d *Dispatcher) Register(client *AppPush) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.clients[client.Provider] = client
+}
+
+func (d *Dispatcher) Client(platform PlatformType) (client *AppPush, ok bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	client, ok = d.clients[platform]
+	return
+}
+
+// Dispatch groups the targets by vendor and pushes msg to every group
+// concurrently. Targets of a vendor without a registered client are reported
+// under that vendor with MissingPlatformClientErr.
+func (d *Dispatcher) Dispatch(ctx context.Context, msg *Message, targets []Target) (result *DispatchResult, err error) {
+	groups := make(map[PlatformType][]string)
+	for _, target := range targets {
+		groups[target.Platform] = append(groups[target.Platform], target.Token)
+	}
+	result = &DispatchResult{
+		Results: make(map[PlatformType]*PushResult, len(groups)),
+		Errors:  make(map[PlatformType]error),
+	}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for platform, tokens := range groups {
+		client, ok := d.Client(platform)
+		if !ok {
+			result.Errors[platform] = MissingPlatformClientErr
+			continue
+		}
+		wg.Add(1)
+		go func(platform PlatformType, client *AppPush, tokens []string) {
+			defer wg.Done()
+			res, pushErr := client.PushMessage(ctx, msg, tokens)
+			mu.Lock()
+			defer mu.Unlock()
+			result.Results[platform] = res
+			if pushErr != nil {
+				result.Errors[platform] = pushErr
+			}
+		}(platform, client, tokens)
+	}
+	wg.Wait()
+	err = result.Err()
+	return
+}
+
+// Err joins the errors of every vendor, in platform order.
+func (r *DispatchResult) Err() error {
+	platforms := make([]PlatformType, 0, len(r.Errors))
+	for platform := range r.Errors {
+		platforms = append(platforms, platform)
+	}
+	sort.Slice(platforms, func(i, j int) bool { return platforms[i] < platforms[j] })
+	errs := make([]error, 0, len(platforms))
+	for _, platform := range platforms {
+		errs = append(errs, fmt.Errorf("%s: %w", platform, r.Errors[platform]))
+	}
+	return errors.Join(errs...)
+}
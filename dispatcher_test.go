@@ -0,0 +1,59 @@
+package go_app_push
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestDispatchGroupsTargets(t *testing.T) {
+	srv := newVendorServer()
+	defer srv.Close()
+	cfgs := vendorConfigs(srv.URL)
+	d, err := NewDispatcherWithConfig(cfgs[0], cfgs[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	targets := []Target{
+		{PlatformXIAOMI, "x1"},
+		{PlatformMEIZU, "m1"},
+		{PlatformOPPO, "o1"},
+		{PlatformXIAOMI, "x2"},
+		{PlatformVIVO, "v1"},
+	}
+	result, err := d.Dispatch(context.Background(), &Message{Title: "t", Body: "b"}, targets)
+	if !errors.Is(err, MissingPlatformClientErr) {
+		t.Fatalf("err = %v, want MissingPlatformClientErr", err)
+	}
+	if len(result.Results) != 2 {
+		t.Fatalf("results for %d vendors, want 2", len(result.Results))
+	}
+	var tokens []string
+	for _, b := range result.Results[PlatformXIAOMI].Batches {
+		tokens = append(tokens, b.Tokens...)
+	}
+	if !reflect.DeepEqual(tokens, []string{"x1", "x2"}) {
+		t.Errorf("xiaomi tokens = %v", tokens)
+	}
+	if res := result.Results[PlatformOPPO]; res == nil || len(res.Batches) != 1 || res.Batches[0].Tokens[0] != "o1" {
+		t.Errorf("oppo result = %+v", res)
+	}
+	if len(result.Errors) != 2 || result.Errors[PlatformVIVO] == nil || result.Errors[PlatformMEIZU] == nil {
+		t.Errorf("errors = %v, want vivo and meizu", result.Errors)
+	}
+	// the joined text is in platform order
+	want := "vivo: missing push client for platform err\nmeizu: missing push client for platform err"
+	for i := 0; i < 10; i++ {
+		if got := result.Err().Error(); got != want {
+			t.Fatalf("Err() = %q, want %q", got, want)
+		}
+	}
+}
+
+func TestDispatchResultNoErrors(t *testing.T) {
+	result := &DispatchResult{Results: map[PlatformType]*PushResult{}, Errors: map[PlatformType]error{}}
+	if err := result.Err(); err != nil {
+		t.Errorf("Err() = %v, want nil", err)
+	}
+}
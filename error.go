@@ -1,6 +1,20 @@
 package go_app_push
 
-import "errors"
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	maxErrorBody    = 1024 // response body kept in PushError.Body
+	maxErrorBodyMsg = 200  // part of it repeated by Error()
+)
 
 var (
 	OPPOMissingDeviceErr       = errors.New("missing device err")
@@ -16,4 +30,242 @@ var (
 	MissingMeiZuAppKeyErr      = errors.New("missing meizu appid err")
 	MissingAppKeyErr           = errors.New("missing appkey err")
 	MissingAppPkgNameErr       = errors.New("missing appPkgName err")
+	MissingPlatformClientErr   = errors.New("missing push client for platform err")
+	LocalRateLimitErr          = errors.New("push rate limit exceeded err")
+	CircuitOpenErr             = errors.New("circuit breaker open err")
+	ReplayMissErr              = errors.New("no recorded exchange for request err")
+	InvalidBaseURLErr          = errors.New("invalid base url err")
+	EmptyAccessTokenErr        = errors.New("empty access token err")
+	InvalidPlatformErr         = errors.New("invalid platform err")
+	InvalidDeviceErr           = errors.New("invalid device err")
+	InvalidConfigValueErr      = errors.New("invalid config value err")
+	InvalidProxyURLErr         = errors.New("invalid proxy url err")
+	InvalidCertificateErr      = errors.New("invalid certificate err")
+)
+
+// ConfigError names the setting that failed to load or validate, by its key
+// in the config file, e.g. "huawei.client_secret".
+type ConfigError struct {
+	Field string
+	Err   error
+}
+
+func (e *ConfigError) Error() string {
+	return "config " + e.Field + ": " + e.Err.Error()
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+func configErr(field string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &ConfigError{Field: field, Err: err}
+}
+
+// ErrorCategory classifies vendor failures independently of the vendor code.
+// It implements error so that errors.Is(err, ErrorCategoryRateLimited) matches
+// any PushError of that category.
+type ErrorCategory int
+
+const (
+	ErrorCategoryUnknown ErrorCategory = iota
+	ErrorCategoryInvalidToken
+	ErrorCategoryQuotaExceeded
+	ErrorCategoryAuthFailed
+	ErrorCategoryRateLimited
+	ErrorCategoryPayloadInvalid
+	ErrorCategoryTransient
 )
+
+func (c ErrorCategory) String() string {
+	switch c {
+	case ErrorCategoryInvalidToken:
+		return "invalid token"
+	case ErrorCategoryQuotaExceeded:
+		return "quota exceeded"
+	case ErrorCategoryAuthFailed:
+		return "auth failed"
+	case ErrorCategoryRateLimited:
+		return "rate limited"
+	case ErrorCategoryPayloadInvalid:
+		return "payload invalid"
+	case ErrorCategoryTransient:
+		return "transient"
+	}
+	return "unknown"
+}
+
+func (c ErrorCategory) Error() string {
+	return c.String() + " err"
+}
+
+// PushError is returned for every failure reported by a vendor, either through
+// the HTTP status or through the vendor code in the response body.
+type PushError struct {
+	Provider   PlatformType
+	Endpoint   string
+	StatusCode int
+	Code       string
+	Message    string
+	Category   ErrorCategory
+	RetryAfter time.Duration // parsed from the Retry-After header, if any
+	Header     http.Header   // response headers of a non-200 response, secrets redacted
+	Body       string        // start of a non-200 response body, secrets redacted
+	Err        error
+}
+
+func (e *PushError) Error() string {
+	s := fmt.Sprintf("%s push err (%s): endpoint=%s status=%d", e.Provider, e.Category.String(), e.Endpoint, e.StatusCode)
+	if len(e.Code) > 0 {
+		s += " code=" + e.Code
+	}
+	if len(e.Message) > 0 {
+		s += " msg=" + e.Message
+	} else if len(e.Body) > maxErrorBodyMsg {
+		s += " body=" + e.Body[:maxErrorBodyMsg] + "..."
+	} else if len(e.Body) > 0 {
+		s += " body=" + e.Body
+	}
+	if e.Err != nil {
+		s += ": " + e.Err.Error()
+	}
+	return Redact(s)
+}
+
+func (e *PushError) Unwrap() error {
+	return e.Err
+}
+
+func (e *PushError) Is(target error) bool {
+	category, ok := target.(ErrorCategory)
+	return ok && category == e.Category
+}
+
+// Retryable reports whether sending the same request again may succeed.
+func (e *PushError) Retryable() bool {
+	return e.Category == ErrorCategoryTransient || e.Category == ErrorCategoryRateLimited
+}
+
+// newVendorErr builds the error for a non-success vendor code, classified with
+// the vendor's code table. The request layer fills in endpoint and status.
+func newVendorErr(provider PlatformType, code, msg string) *PushError {
+	return &PushError{
+		Provider: provider,
+		Code:     code,
+		Message:  msg,
+		Category: vendorCategory(provider, code),
+	}
+}
+
+func vendorCategory(provider PlatformType, code string) ErrorCategory {
+	switch provider {
+	case PlatformXIAOMI:
+		return xmErrCategories[code]
+	case PlatformHUAWEI:
+		return hwErrCategories[code]
+	case PlatformOPPO:
+		return opErrCategories[code]
+	case PlatformVIVO:
+		return voErrCategories[code]
+	case PlatformMEIZU:
+		return mzErrCategories[code]
+	}
+	return ErrorCategoryUnknown
+}
+
+// setResponse attaches a non-200 response to e. A vendor code found in the
+// body refines the category of the status, but 429 and 5xx stay retryable.
+func (e *PushError) setResponse(header http.Header, body []byte) {
+	e.Header = RedactHeader(header)
+	if len(body) > maxErrorBody {
+		body = append(body[:maxErrorBody:maxErrorBody], "..."...)
+	}
+	e.Body = Redact(string(bytes.TrimSpace(body)))
+	e.Code, e.Message = parseVendorBody(body)
+	if e.Retryable() {
+		return
+	}
+	if category := vendorCategory(e.Provider, e.Code); category != ErrorCategoryUnknown {
+		e.Category = category
+	}
+}
+
+var (
+	vendorCodeKeys = []string{"code", "result", "error", "errorCode", "error_code"}
+	vendorMsgKeys  = []string{"message", "msg", "desc", "description", "reason", "error_description", "error_msg"}
+)
+
+// parseVendorBody reads the code and message of a JSON error body, the
+// vendors disagree on the key names.
+func parseVendorBody(body []byte) (code, msg string) {
+	var m map[string]interface{}
+	d := json.NewDecoder(bytes.NewReader(body))
+	d.UseNumber()
+	if d.Decode(&m) != nil {
+		return
+	}
+	for _, key := range vendorCodeKeys {
+		switch v := m[key].(type) {
+		case json.Number:
+			code = v.String()
+		case string:
+			code = v
+		}
+		if len(code) > 0 {
+			break
+		}
+	}
+	for _, key := range vendorMsgKeys {
+		if v, ok := m[key].(string); ok && len(v) > 0 {
+			msg = Redact(v)
+			break
+		}
+	}
+	return
+}
+
+// wrapRequestErr classifies an error returned by roundTrip. It is only
+// redacted once ctx, the caller's context, has ended, and for request building
+// and decoding errors. Client and transport timeouts are transient.
+func wrapRequestErr(ctx context.Context, provider PlatformType, endpoint string, statusCode int, err error) error {
+	if err == nil || ctx.Err() != nil {
+		return redactErr(err)
+	}
+	pe := &PushError{Provider: provider, Endpoint: endpoint, StatusCode: statusCode, Err: err}
+	var ue *url.Error
+	switch {
+	case errors.Is(err, HttpServerErr):
+		pe.Category = statusCategory(statusCode)
+	case errors.As(err, &ue), errors.Is(err, context.DeadlineExceeded):
+		pe.Category = ErrorCategoryTransient
+	default:
+		return redactErr(err)
+	}
+	return pe
+}
+
+// vendorCode returns the vendor code carried by err, if any.
+func vendorCode(err error) string {
+	var pe *PushError
+	if errors.As(err, &pe) {
+		return pe.Code
+	}
+	return ""
+}
+
+func statusCategory(statusCode int) ErrorCategory {
+	switch {
+	case statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden:
+		return ErrorCategoryAuthFailed
+	case statusCode == http.StatusTooManyRequests:
+		return ErrorCategoryRateLimited
+	case statusCode == http.StatusBadRequest || statusCode == http.StatusRequestEntityTooLarge:
+		return ErrorCategoryPayloadInvalid
+	case statusCode == http.StatusRequestTimeout || statusCode >= 500:
+		return ErrorCategoryTransient
+	}
+	return ErrorCategoryUnknown
+}
@@ -0,0 +1,85 @@
+package go_app_push
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newSlowServer(delay time.Duration) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+		}
+	}))
+}
+
+func TestClientTimeoutIsTransient(t *testing.T) {
+	srv := newSlowServer(300 * time.Millisecond)
+	defer srv.Close()
+	client, err := NewAppPushWithConfig(Config{
+		Provider:   PlatformXIAOMI,
+		AppPkgName: "p",
+		XiaoMi:     XiaoMiConfig{AppSecret: "s", BaseURL: srv.URL},
+		HTTP:       HTTPOptions{Timeout: 50 * time.Millisecond},
+		Retry:      RetryPolicy{MaxAttempts: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Push("t", "b", nil, []string{"a"})
+	var pe *PushError
+	if !errors.As(err, &pe) {
+		t.Fatalf("want *PushError, got %T: %v", err, err)
+	}
+	if pe.Provider != PlatformXIAOMI || pe.Endpoint != PRO_API_XM_ALIAS || pe.Category != ErrorCategoryTransient {
+		t.Errorf("got %v", pe)
+	}
+}
+
+func TestCallerDeadlineIsReturnedUnchanged(t *testing.T) {
+	srv := newSlowServer(300 * time.Millisecond)
+	defer srv.Close()
+	client, err := NewAppPushWithConfig(Config{
+		Provider:   PlatformXIAOMI,
+		AppPkgName: "p",
+		XiaoMi:     XiaoMiConfig{AppSecret: "s", BaseURL: srv.URL},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = client.PushWithContext(ctx, "t", "b", nil, []string{"a"})
+	var pe *PushError
+	if !errors.Is(err, context.DeadlineExceeded) || errors.As(err, &pe) {
+		t.Errorf("got %T: %v", err, err)
+	}
+}
+
+// The signed Meizu Verify URL ends up in the *url.Error of a caller timeout.
+func TestPassedThroughErrorIsRedacted(t *testing.T) {
+	srv := newSlowServer(300 * time.Millisecond)
+	defer srv.Close()
+	client, err := NewAppPushWithConfig(Config{
+		Provider: PlatformMEIZU,
+		MeiZu:    MeiZuConfig{AppId: 1, AppKey: "k", BaseURL: srv.URL},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = client.Verify(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %T: %v", err, err)
+	}
+	if msg := err.Error(); !strings.Contains(msg, "sign="+redacted) {
+		t.Errorf("sign not redacted: %s", msg)
+	}
+}
@@ -0,0 +1,128 @@
+package go_app_push
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// HTTPOptions configures the http.Client built by NewHTTPClient. Zero values
+// use the defaults below.
+type HTTPOptions struct {
+	Timeout             time.Duration     // total time of one request, default 30s
+	DialTimeout         time.Duration     // default 10s
+	TLSHandshakeTimeout time.Duration     // default 10s
+	IdleConnTimeout     time.Duration     // default 90s
+	MaxIdleConns        int               // default 100
+	MaxIdleConnsPerHost int               // default 32
+	MaxConnsPerHost     int               // default 0, no limit
+	RootCAs             *x509.CertPool    // nil trusts the system roots
+	Certificates        []tls.Certificate // client certificates for mutual TLS
+	// ProxyURL sends every request through an http, https or socks5 proxy,
+	// credentials go in the user info. Empty uses the proxy environment
+	// variables. An invalid URL fails every request instead of bypassing it.
+	ProxyURL           string
+	DisableHTTP2       bool
+	InsecureSkipVerify bool // only for local mock servers
+	// WrapTransport wraps the pooled transport, e.g. with NewRecorder to
+	// capture vendor exchanges.
+	WrapTransport func(http.RoundTripper) http.RoundTripper
+}
+
+var (
+	defaultHTTPClientOnce sync.Once
+	defaultHTTPClient     *http.Client
+)
+
+// NewHTTPClient builds a pooled client with TLS verification on unless
+// InsecureSkipVerify is set.
+func NewHTTPClient(opts HTTPOptions) *http.Client {
+	if opts.Timeout == 0 {
+		opts.Timeout = 30 * time.Second
+	}
+	if opts.DialTimeout == 0 {
+		opts.DialTimeout = 10 * time.Second
+	}
+	if opts.TLSHandshakeTimeout == 0 {
+		opts.TLSHandshakeTimeout = 10 * time.Second
+	}
+	if opts.IdleConnTimeout == 0 {
+		opts.IdleConnTimeout = 90 * time.Second
+	}
+	if opts.MaxIdleConns == 0 {
+		opts.MaxIdleConns = 100
+	}
+	if opts.MaxIdleConnsPerHost == 0 {
+		opts.MaxIdleConnsPerHost = 32
+	}
+	dialer := &net.Dialer{
+		Timeout:   opts.DialTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	tr := &http.Transport{
+		Proxy:               proxyFunc(opts.ProxyURL),
+		DialContext:         dialer.DialContext,
+		TLSHandshakeTimeout: opts.TLSHandshakeTimeout,
+		IdleConnTimeout:     opts.IdleConnTimeout,
+		MaxIdleConns:        opts.MaxIdleConns,
+		MaxIdleConnsPerHost: opts.MaxIdleConnsPerHost,
+		MaxConnsPerHost:     opts.MaxConnsPerHost,
+		ForceAttemptHTTP2:   !opts.DisableHTTP2,
+		TLSClientConfig: &tls.Config{
+			MinVersion:         tls.VersionTLS12,
+			RootCAs:            opts.RootCAs,
+			Certificates:       opts.Certificates,
+			InsecureSkipVerify: opts.InsecureSkipVerify,
+		},
+	}
+	if opts.DisableHTTP2 {
+		tr.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+	var rt http.RoundTripper = tr
+	if opts.WrapTransport != nil {
+		rt = opts.WrapTransport(tr)
+	}
+	return &http.Client{Transport: rt, Timeout: opts.Timeout}
+}
+
+func proxyFunc(proxyURL string) func(*http.Request) (*url.URL, error) {
+	if len(proxyURL) == 0 {
+		return http.ProxyFromEnvironment
+	}
+	u, err := parseProxyURL(proxyURL)
+	if err != nil {
+		return func(*http.Request) (*url.URL, error) { return nil, err }
+	}
+	return http.ProxyURL(u)
+}
+
+// parseProxyURL accepts http, https, socks5 and socks5h proxies. Errors
+// never repeat the password.
+func parseProxyURL(proxyURL string) (u *url.URL, err error) {
+	u, err = url.Parse(proxyURL)
+	if err != nil {
+		err = InvalidProxyURLErr
+		return
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+		if len(u.Host) > 0 {
+			return
+		}
+	}
+	err = fmt.Errorf("%w: %q", InvalidProxyURLErr, u.Redacted())
+	return
+}
+
+// sharedHTTPClient is used by vendor clients created without an HTTPClient.
+func sharedHTTPClient() *http.Client {
+	defaultHTTPClientOnce.Do(func() {
+		defaultHTTPClient = NewHTTPClient(HTTPOptions{})
+	})
+	return defaultHTTPClient
+}
@@ -1,11 +1,13 @@
 package go_app_push
 
 import (
+	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"github.com/google/go-querystring/query"
+	"net/http"
 	"net/url"
+	"sync"
 	"time"
 )
 
@@ -21,28 +23,32 @@ const (
 const (
 	HuaWeiMsgActionTypeNil    HuaWeiMsgActionType = 0
 	HuaWeiMsgActionTypeCustom HuaWeiMsgActionType = 1
-	HuaWeiMsgActionTypeUrl    HuaWeiMsgActionType = 3
+	HuaWeiMsgActionTypeUrl    HuaWeiMsgActionType = 2 // was 3 (open app) before, use HuaWeiMsgActionTypeApp for that
 	HuaWeiMsgActionTypeApp    HuaWeiMsgActionType = 3
 )
 
 const (
-	PRO_API_HW_TOKEN string = "https://login.cloud.huawei.com/oauth2/v2/token"
-	PRO_API_HW_SEND  string = "https://api.push.hicloud.com/pushsend.do"
+	PRO_API_HW_AUTH_PREFIX string = "https://login.cloud.huawei.com"
+	PRO_API_HW_PREFIX      string = "https://api.push.hicloud.com"
+	PRO_API_HW_TOKEN       string = "https://login.cloud.huawei.com/oauth2/v2/token"
+	PRO_API_HW_SEND        string = "https://api.push.hicloud.com/pushsend.do"
 )
 
 type HuaWeiPush struct {
-	GrantType      string `url:"grant_type,omitempty" json:"grant_type,omitempty"`
-	ClientId       string `url:"client_id,omitempty" json:"client_id,omitempty"`
-	ClientSecret   string `url:"client_secret,omitempty" json:"client_secret,omitempty"`
-	Scope          string `url:"scope,omitempty" json:"scope,omitempty"` //nsp.auth nsp.user nsp.vfs nsp.ping openpush.message
-	AccessToken    string `url:"-" json:"-"`
-	TokenExpiredAt int64  `url:"-" json:"-"`
-	AppPkgName     string `url:"-" json:"-"`
-	NspCtx         struct {
+	GrantType    string `url:"grant_type,omitempty" json:"grant_type,omitempty"`
+	ClientId     string `url:"client_id,omitempty" json:"client_id,omitempty"`
+	ClientSecret string `url:"client_secret,omitempty" json:"client_secret,omitempty"`
+	Scope        string `url:"scope,omitempty" json:"scope,omitempty"` //nsp.auth nsp.user nsp.vfs nsp.ping openpush.message
+	AppPkgName   string `url:"-" json:"-"`
+	NspCtx       struct {
 		Ver   string `json:"ver"`
 		AppId string `json:"appId"`
 	} `url:"-" json:"-"`
-	BroadCast HWBroadCastPayload
+	AuthBaseURL   string `url:"-" json:"-"` // replaces PRO_API_HW_AUTH_PREFIX when set
+	BaseURL       string `url:"-" json:"-"` // replaces PRO_API_HW_PREFIX when set
+	ClientOptions `url:"-" json:"-"`
+	tokenOnce     sync.Once
+	tokens        *AccessTokenProvider
 }
 
 type HWBroadCastPayload struct {
@@ -51,7 +57,7 @@ type HWBroadCastPayload struct {
 	NspSvc         string    `url:"nsp_svc,omitempty" json:"nsp_svc,omitempty"`
 	DeviceTokenStr string    `url:"device_token_list,omitempty" json:"device_token_list,omitempty"`
 	DeviceTokens   []string  `url:"-" json:"-"`
-	ExpireTime     int       `url:"expire_time,omitempty" json:"expire_time,omitempty"`
+	ExpireTime     string    `url:"expire_time,omitempty" json:"expire_time,omitempty"` //2013-08-29T19:55, was an int before
 	NspTs          int64     `url:"nsp_ts,omitempty" json:"nsp_ts,omitempty"`
 	Payload        HWPayload `url:"-" json:"-"`
 }
@@ -80,6 +86,20 @@ type HWPayload struct {
 	} `json:"hps"`
 }
 
+// hwErrCategories maps Huawei push codes to error categories.
+var hwErrCategories = map[string]ErrorCategory{
+	"80100002": ErrorCategoryPayloadInvalid, //token数量不正确
+	"80100003": ErrorCategoryPayloadInvalid, //消息结构体错误
+	"80100004": ErrorCategoryPayloadInvalid, //消息过期时间小于当前时间
+	"80200001": ErrorCategoryAuthFailed,     //OAuth认证错误
+	"80200003": ErrorCategoryAuthFailed,     //OAuth Token过期
+	"80300002": ErrorCategoryAuthFailed,     //APP被禁止发送
+	"80300007": ErrorCategoryInvalidToken,   //所有token都是无效的
+	"80300008": ErrorCategoryPayloadInvalid, //消息体大小超过限制
+	"80300010": ErrorCategoryPayloadInvalid, //token数量超过限制
+	"81000001": ErrorCategoryTransient,      //系统内部错误
+}
+
 type HWTokenResponse struct {
 	Error            string `json:"error,omitempty"`
 	ErrorDescription string `json:"error_description,omitempty"`
@@ -88,6 +108,12 @@ type HWTokenResponse struct {
 	Scope            string `json:"scope,omitempty"`
 }
 
+type HWPartialResult struct {
+	Success       int      `json:"success"`
+	Failure       int      `json:"failure"`
+	IllegalTokens []string `json:"illegal_tokens"`
+}
+
 type HWPushResponse struct {
 	Code      string `json:"code,omitempty"`
 	Msg       string `json:"msg,omitempty"`
@@ -107,14 +133,20 @@ func (hw *HuaWeiPush) ms() int64 {
 	return time.Now().UnixNano() / 1000000
 }
 
-func (hw *HuaWeiPush) getToken() (err error) {
+func (hw *HuaWeiPush) getToken(ctx context.Context) (accessToken AccessToken, err error) {
+	accessToken, _, err = hw.fetchToken(ctx)
+	return
+}
+
+func (hw *HuaWeiPush) fetchToken(ctx context.Context) (accessToken AccessToken, header http.Header, err error) {
 	req, err := hw.buildReq(PRO_API_HW_TOKEN)
 	if err != nil {
 		return
 	}
+	req.Check = hw.checkToken
 	v, _ := query.Values(hw)
 	req.Body = []byte(v.Encode())
-	body, _, _, err := req.doPushRequest()
+	body, _, header, err := req.doPushRequest(ctx)
 	if err != nil {
 		return
 	}
@@ -123,15 +155,41 @@ func (hw *HuaWeiPush) getToken() (err error) {
 	if err != nil {
 		return
 	}
-	hw.AccessToken = token.AccessToken
-	hw.TokenExpiredAt = hw.ms() + token.ExpiresIn*1000
+	accessToken.Token = token.AccessToken
+	accessToken.CreatedAt = hw.ms()
+	accessToken.ExpiresAt = accessToken.CreatedAt + token.ExpiresIn*1000
 	return
 }
 
-func (hw *HuaWeiPush) checkTokenExpired() {
-	if hw.TokenExpiredAt < hw.ms() {
-		hw.getToken()
-	}
+// Verify requests an access token unless a cached one is valid. Huawei checks
+// the package name only when a message is sent.
+func (hw *HuaWeiPush) Verify(ctx context.Context) (report *VerifyReport, err error) {
+	return hw.verify(ctx, false)
+}
+
+// VerifyFresh is Verify, but always requests a new access token.
+func (hw *HuaWeiPush) VerifyFresh(ctx context.Context) (report *VerifyReport, err error) {
+	return hw.verify(ctx, true)
+}
+
+func (hw *HuaWeiPush) verify(ctx context.Context, force bool) (report *VerifyReport, err error) {
+	report = newVerifyReport(PlatformHUAWEI, PRO_API_HW_TOKEN)
+	start := time.Now()
+	token, header, err := report.token(ctx, hw.tokenProvider(), force, hw.fetchToken)
+	err = report.observe(start, header, token, err)
+	report.hint("package name is not checked by the token endpoint")
+	return
+}
+
+func (hw *HuaWeiPush) tokenProvider() *AccessTokenProvider {
+	hw.tokenOnce.Do(func() {
+		hw.tokens = newTokenProvider(PlatformHUAWEI, hw.ClientId, &hw.ClientOptions, hw.getToken)
+	})
+	return hw.tokens
+}
+
+func (hw *HuaWeiPush) checkTokenExpired(ctx context.Context) (accessToken string, err error) {
+	return hw.tokenProvider().Token(ctx)
 }
 
 func (hw *HuaWeiPush) buildReq(url string) (req *PushReq, err error) {
@@ -147,58 +205,71 @@ func (hw *HuaWeiPush) buildReq(url string) (req *PushReq, err error) {
 		err = HWMissingClientSecretErr
 		return
 	}
-	if url != PRO_API_HW_TOKEN {
-		hw.checkTokenExpired()
-	}
-	fmt.Printf("\nurl:%s\n", url)
 	req = newPushReq()
+	hw.apply(req, PlatformHUAWEI, url)
 	req.Headers = make(map[string]string, 0)
 	req.Method = "POST"
-	req.Url = url
+	if url == PRO_API_HW_TOKEN {
+		req.Url = endpointURL(hw.AuthBaseURL, PRO_API_HW_AUTH_PREFIX, url)
+	} else {
+		req.Url = endpointURL(hw.BaseURL, PRO_API_HW_PREFIX, url)
+	}
 	return
 }
 
-func (hw *HuaWeiPush) buildHWBraodCast() {
-	//hw.BroadCast = HWBroadCastPayload{}
-	hw.BroadCast.AccessToken = hw.AccessToken
-	fmt.Printf("\nhw.BroadCast.AccessToken:%s\n", hw.BroadCast.AccessToken)
-	hw.BroadCast.NspSvc = "openpush.message.api.send"
-	hw.BroadCast.NspTs = time.Now().Unix()
-	//hw.BroadCast.Payload = HWPayload{}
-	if hw.BroadCast.Payload.HPS.Msg.MsgType == HuaWeiMsgTypeNil {
-		hw.BroadCast.Payload.HPS.Msg.MsgType = HuaWeiMsgTypeSystemNotifyAsync
-		hw.BroadCast.Payload.HPS.Msg.Action.ActionType = HuaWeiMsgActionTypeUrl
-		//hw.BroadCast.Payload.HPS.Msg.Action.Param.Intent = ""
-		//hw.BroadCast.Payload.HPS.Msg.Action.Param.Url = "xx"
-		hw.BroadCast.Payload.HPS.Msg.Action.Param.AppPkgName = hw.AppPkgName
+func (hw *HuaWeiPush) buildHWBraodCast(broadCast *HWBroadCastPayload, accessToken string) {
+	broadCast.AccessToken = accessToken
+	broadCast.NspSvc = "openpush.message.api.send"
+	broadCast.NspTs = time.Now().Unix()
+	if broadCast.Payload.HPS.Msg.MsgType == HuaWeiMsgTypeNil {
+		broadCast.Payload.HPS.Msg.MsgType = HuaWeiMsgTypeSystemNotifyAsync
+		broadCast.Payload.HPS.Msg.Action.ActionType = HuaWeiMsgActionTypeApp
+		//broadCast.Payload.HPS.Msg.Action.Param.Intent = ""
+		//broadCast.Payload.HPS.Msg.Action.Param.Url = "xx"
+		broadCast.Payload.HPS.Msg.Action.Param.AppPkgName = hw.AppPkgName
 	}
 }
 
-func (hw *HuaWeiPush) buildBatchPush(tokens []string) (requestId string, err error) {
+func (hw *HuaWeiPush) buildBatchPush(ctx context.Context, broadCast HWBroadCastPayload, batch *BatchResult) (err error) {
+	defer func() {
+		batch.done(err)
+	}()
 	//nspCtx, _ := query.Values()
 	//hw.NspCtx.AppId = hw.ClientId
 	//fmt.Println(hw.NspCtx)
 	nspCtxByt, _ := json.Marshal(hw.NspCtx)
 	nspCtxVal := url.Values{}
 	nspCtxVal.Add("nsp_ctx", string(nspCtxByt))
-	req, err := hw.buildReq(fmt.Sprintf("%s?%s", PRO_API_HW_SEND, nspCtxVal.Encode()))
+	req, err := hw.buildReq(PRO_API_HW_SEND)
 	if err != nil {
 		return
 	}
-	hw.buildHWBraodCast()
-	if len(tokens) > 0 {
-		hw.BroadCast.DeviceTokens = make([]string, 0, 0)
-		for _, token := range tokens {
-			hw.BroadCast.DeviceTokens = append(hw.BroadCast.DeviceTokens, token)
-		}
-		tokenBytArr, _ := json.Marshal(hw.BroadCast.DeviceTokens)
-		hw.BroadCast.DeviceTokenStr = string(tokenBytArr)
+	req.Url = fmt.Sprintf("%s?%s", req.Url, nspCtxVal.Encode())
+	req.Check = hw.check
+	accessToken, err := hw.checkTokenExpired(ctx)
+	if err != nil {
+		return
+	}
+	hw.buildHWBraodCast(&broadCast, accessToken)
+	if len(batch.Tokens) > 0 {
+		broadCast.DeviceTokens = batch.Tokens
+		tokenBytArr, _ := json.Marshal(broadCast.DeviceTokens)
+		broadCast.DeviceTokenStr = string(tokenBytArr)
 	}
-	broadCastBytArr, _ := json.Marshal(hw.BroadCast.Payload)
-	hw.BroadCast.PayloadStr = string(broadCastBytArr)
-	v, _ := query.Values(hw.BroadCast)
+	broadCastBytArr, _ := json.Marshal(broadCast.Payload)
+	broadCast.PayloadStr = string(broadCastBytArr)
+	v, _ := query.Values(broadCast)
 	req.Body = []byte(v.Encode())
-	body, _, _, err := req.doPushRequest()
+	req.Expired = hw.authExpired
+	req.Reauth = func(ctx context.Context) (err error) {
+		if broadCast.AccessToken, err = hw.tokenProvider().Renew(ctx, broadCast.AccessToken); err != nil {
+			return
+		}
+		v, _ := query.Values(broadCast)
+		req.Body = []byte(v.Encode())
+		return
+	}
+	body, err := req.send(ctx, batch)
 	if err != nil {
 		return
 	}
@@ -207,47 +278,111 @@ func (hw *HuaWeiPush) buildBatchPush(tokens []string) (requestId string, err err
 	if err != nil {
 		return
 	}
-	fmt.Printf("\nresp:%v\n", resp)
-	if resp.Code != "80000000" {
-		err = errors.New(resp.Msg)
+	batch.Code = resp.Code
+	batch.RequestId = resp.RequestId
+	var rejected []string
+	if resp.Code == "80100000" {
+		//部分token非法
+		partial := HWPartialResult{}
+		json.Unmarshal([]byte(resp.Msg), &partial)
+		rejected = partial.IllegalTokens
+	}
+	batch.settle(rejected)
+	return
+}
+
+func (hw *HuaWeiPush) check(body []byte) (err error) {
+	resp := HWPushResponse{}
+	if err = json.Unmarshal(body, &resp); err != nil {
 		return
 	}
-	requestId = resp.RequestId
+	if resp.Code != "80000000" && resp.Code != "80100000" {
+		err = newVendorErr(PlatformHUAWEI, resp.Code, resp.Msg)
+	}
 	return
 }
 
-func (hw *HuaWeiPush) push(title, content string, extras map[string]string, tokens []string) (err error) {
-	hw.BroadCast.Payload.HPS.Msg.Body.Title = title
-	hw.BroadCast.Payload.HPS.Msg.Body.Content = content
-	if len(extras) > 0 {
-		hw.BroadCast.Payload.HPS.Ext.Customize = make([]map[string]string, 0, 0)
-		for k, v := range extras {
+// authExpired reports a session timeout, flagged by NSP_STATUS 6 on the
+// legacy gateway, or an expired OAuth token.
+func (hw *HuaWeiPush) authExpired(header http.Header, err error) bool {
+	return header.Get("NSP_STATUS") == "6" || vendorCode(err) == "80200003"
+}
+
+func (hw *HuaWeiPush) checkToken(body []byte) (err error) {
+	token := HWTokenResponse{}
+	if err = json.Unmarshal(body, &token); err != nil {
+		return
+	}
+	if len(token.Error) > 0 {
+		err = &PushError{
+			Provider: PlatformHUAWEI,
+			Code:     token.Error,
+			Message:  token.ErrorDescription,
+			Category: ErrorCategoryAuthFailed,
+		}
+	}
+	return
+}
+
+func (hw *HuaWeiPush) applyMessage(msg *Message) (broadCast HWBroadCastPayload, warnings []string) {
+	w := &messageWarnings{provider: PlatformHUAWEI}
+	hps := &broadCast.Payload.HPS
+	hps.Msg.MsgType = HuaWeiMsgTypeSystemNotifyAsync
+	hps.Msg.Body.Title = msg.Title
+	hps.Msg.Body.Content = msg.Body
+	hps.Msg.Action.Param.AppPkgName = hw.AppPkgName
+	switch msg.ClickAction.Type {
+	case ClickActionUrl:
+		hps.Msg.Action.ActionType = HuaWeiMsgActionTypeUrl
+		hps.Msg.Action.Param.Url = msg.ClickAction.Url
+	case ClickActionActivity:
+		hps.Msg.Action.ActionType = HuaWeiMsgActionTypeCustom
+		hps.Msg.Action.Param.Intent = msg.ClickAction.Activity
+	case ClickActionIntent:
+		hps.Msg.Action.ActionType = HuaWeiMsgActionTypeCustom
+		hps.Msg.Action.Param.Intent = msg.ClickAction.Intent
+	default:
+		hps.Msg.Action.ActionType = HuaWeiMsgActionTypeApp
+	}
+	if len(msg.Extras) > 0 {
+		hps.Ext.Customize = make([]map[string]string, 0, 0)
+		for k, v := range msg.Extras {
 			tmp := make(map[string]string, 0)
 			tmp[k] = v
-			hw.BroadCast.Payload.HPS.Ext.Customize = append(hw.BroadCast.Payload.HPS.Ext.Customize, tmp)
+			hps.Ext.Customize = append(hps.Ext.Customize, tmp)
 		}
 	}
+	if msg.TTL > 0 {
+		broadCast.ExpireTime = time.Now().Add(msg.TTL).Format("2006-01-02T15:04")
+	}
+	w.unsupported("subtitle", len(msg.SubTitle) > 0)
+	w.unsupported("sound", len(msg.Sound) > 0)
+	w.unsupported("badge", msg.Badge > 0)
+	w.unsupported("channel id", len(msg.ChannelId) > 0)
+	w.unsupported("image", len(msg.ImageUrl) > 0)
+	w.unsupported("collapse key", len(msg.CollapseKey) > 0)
+	warnings = w.list
+	return
+}
+
+func (hw *HuaWeiPush) push(ctx context.Context, msg *Message, tokens []string) (result *PushResult, err error) {
+	result = newPushResult(PlatformHUAWEI)
+	broadCast, warnings := hw.applyMessage(msg)
+	result.Warnings = warnings
 	if len(tokens) > 0 {
-		hw.BroadCast.DeviceTokens = make([]string, 0, 0)
-		if len(tokens) > 1000 {
-			reqLengthMod := len(tokens) % 1000
-			reqLoop := len(tokens) / 1000
-			if reqLoop > 0 {
-				for i := 0; i < reqLoop; i++ {
-					start := i * 1000
-					tmpTokens := tokens[start : start+1000]
-					_, err = hw.buildBatchPush(tmpTokens)
-				}
-			}
-			if reqLengthMod > 0 {
-				leftTokens := tokens[reqLoop*1000:]
-				_, err = hw.buildBatchPush(leftTokens)
+		for _, chunk := range splitTokens(tokens, 1000) {
+			if err = ctx.Err(); err != nil {
+				return
 			}
-		} else {
-			_, err = hw.buildBatchPush(tokens)
+			batch := &BatchResult{Endpoint: PRO_API_HW_SEND, Tokens: chunk}
+			hw.buildBatchPush(ctx, broadCast, batch)
+			result.add(batch)
 		}
 	} else {
-		_, err = hw.buildBatchPush([]string{})
+		batch := &BatchResult{Endpoint: PRO_API_HW_SEND}
+		hw.buildBatchPush(ctx, broadCast, batch)
+		result.add(batch)
 	}
+	err = result.Err()
 	return
 }
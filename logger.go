@@ -0,0 +1,106 @@
+package go_app_push
+
+import (
+	"context"
+	"log/slog"
+)
+
+type LogLevel int
+
+const (
+	LogLevelDebug LogLevel = iota
+	LogLevelInfo
+	LogLevelWarn
+	LogLevelError
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LogLevelDebug:
+		return "debug"
+	case LogLevelInfo:
+		return "info"
+	case LogLevelWarn:
+		return "warn"
+	}
+	return "error"
+}
+
+// Field is a structured key/value pair attached to a log entry.
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+func F(key string, value interface{}) Field {
+	return Field{Key: key, Value: value}
+}
+
+// Logger receives the diagnostics of a push client. Request and response
+// bodies are only logged at LogLevelDebug, secrets are redacted before any
+// entry reaches the Logger.
+type Logger interface {
+	Log(ctx context.Context, level LogLevel, msg string, fields ...Field)
+}
+
+// LoggerFunc adapts a function to Logger.
+type LoggerFunc func(ctx context.Context, level LogLevel, msg string, fields ...Field)
+
+func (f LoggerFunc) Log(ctx context.Context, level LogLevel, msg string, fields ...Field) {
+	f(ctx, level, msg, fields...)
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Log(ctx context.Context, level LogLevel, msg string, fields ...Field) {}
+
+// NopLogger discards everything, it is used when no Logger is configured.
+func NopLogger() Logger {
+	return nopLogger{}
+}
+
+type slogLogger struct {
+	l *slog.Logger
+}
+
+// NewSlogLogger adapts l to Logger, a nil l uses slog.Default().
+func NewSlogLogger(l *slog.Logger) Logger {
+	if l == nil {
+		l = slog.Default()
+	}
+	return &slogLogger{l: l}
+}
+
+func (s *slogLogger) Log(ctx context.Context, level LogLevel, msg string, fields ...Field) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	lvl := slogLevel(level)
+	if !s.l.Enabled(ctx, lvl) {
+		return
+	}
+	attrs := make([]slog.Attr, 0, len(fields))
+	for _, f := range fields {
+		attrs = append(attrs, slog.Any(f.Key, f.Value))
+	}
+	s.l.LogAttrs(ctx, lvl, msg, attrs...)
+}
+
+func slogLevel(level LogLevel) slog.Level {
+	switch level {
+	case LogLevelDebug:
+		return slog.LevelDebug
+	case LogLevelInfo:
+		return slog.LevelInfo
+	case LogLevelWarn:
+		return slog.LevelWarn
+	}
+	return slog.LevelError
+}
+
+func logTo(l Logger, ctx context.Context, level LogLevel, msg string, fields ...Field) {
+	if l == nil {
+		return
+	}
+	l.Log(ctx, level, Redact(msg), redactFields(fields)...)
+}
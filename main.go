@@ -1,7 +1,14 @@
 package go_app_push
 
 import (
+	"context"
 	"fmt"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
 )
 
 type PlatformType uint32
@@ -54,8 +61,84 @@ var (
 	VIVOAppSecret string
 )
 
+func (p PlatformType) String() string {
+	switch p {
+	case PlatformHUAWEI:
+		return "huawei"
+	case PlatformOPPO:
+		return "oppo"
+	case PlatformVIVO:
+		return "vivo"
+	case PlatformXIAOMI:
+		return "xiaomi"
+	case PlatformMEIZU:
+		return "meizu"
+	}
+	return "unknown"
+}
+
+// ParsePlatformType accepts the names returned by String, in any case.
+func ParsePlatformType(s string) (p PlatformType, err error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "huawei":
+		p = PlatformHUAWEI
+	case "oppo":
+		p = PlatformOPPO
+	case "vivo":
+		p = PlatformVIVO
+	case "xiaomi":
+		p = PlatformXIAOMI
+	case "meizu":
+		p = PlatformMEIZU
+	default:
+		err = fmt.Errorf("%w: %q", InvalidPlatformErr, s)
+	}
+	return
+}
+
+func (p PlatformType) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+func (p *PlatformType) UnmarshalText(text []byte) (err error) {
+	*p, err = ParsePlatformType(string(text))
+	return
+}
+
+func (d DeviceType) String() string {
+	switch d {
+	case DeviceANDROID:
+		return "android"
+	case DeviceIOS:
+		return "ios"
+	}
+	return "unknown"
+}
+
+// ParseDeviceType accepts "android" and "ios" in any case.
+func ParseDeviceType(s string) (d DeviceType, err error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "android":
+		d = DeviceANDROID
+	case "ios":
+		d = DeviceIOS
+	default:
+		err = fmt.Errorf("%w: %q", InvalidDeviceErr, s)
+	}
+	return
+}
+
+func (d DeviceType) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+func (d *DeviceType) UnmarshalText(text []byte) (err error) {
+	*d, err = ParseDeviceType(string(text))
+	return
+}
+
 type PushInterface interface {
-	push(title, content string, extras map[string]string, tokens []string) (err error)
+	push(ctx context.Context, msg *Message, tokens []string) (result *PushResult, err error)
 }
 
 type AppPush struct {
@@ -66,76 +149,304 @@ type AppPush struct {
 	OPPush   *OPPOPush
 	VOPush   *VIVOPush
 	MZPush   *MeiZuPush
+	Logger   Logger
+	mu       sync.RWMutex
+	cfg      Config                          // the Config the vendor client was built from
+	setters  map[string]func(*ClientOptions) // options changed through the setters, kept by Reload
 }
 
-type AccessToken struct {
-	Token     string
-	CreatedAt int64
+func NewAppPush(c PlatformType) *AppPush {
+	appPush, _ := newAppPush(defaultConfig(c)) // the globals carry no egress settings
+	return appPush
 }
 
-func NewAppPush(c PlatformType) *AppPush {
-	appPush := new(AppPush)
-	switch c {
-	case PlatformXIAOMI:
-		push := newXMPush()
-		push.AppPkgName = AppPkgName
-		push.AppSecret = XMAppSecret
-		push.DeviceType = Device
-		appPush.XMPush = push
+func NewAppPushWithConfig(cfg Config) (appPush *AppPush, err error) {
+	if err = cfg.Validate(); err != nil {
+		return
+	}
+	appPush, err = newAppPush(cfg)
+	return
+}
+
+func newAppPush(cfg Config) (appPush *AppPush, err error) {
+	httpOpts, err := cfg.httpOptions()
+	if err != nil {
+		return
+	}
+	appPush = new(AppPush)
+	switch cfg.Provider {
 	case PlatformHUAWEI:
 		push := newHWPush()
-		push.ClientId = HWClientId
-		push.AppPkgName = AppPkgName
-		push.ClientSecret = HWClientSecret
+		push.ClientId = cfg.HuaWei.ClientId
+		push.AppPkgName = cfg.AppPkgName
+		push.ClientSecret = cfg.HuaWei.ClientSecret
+		push.NspCtx.AppId = cfg.HuaWei.ClientId
+		push.AuthBaseURL = cfg.HuaWei.AuthBaseURL
+		push.BaseURL = cfg.HuaWei.BaseURL
 		appPush.HWPush = push
 	case PlatformOPPO:
 		push := newOPPOPush()
-		push.AppKey = OPPOAppKey
-		push.MasterKey = OPPOMasterKey
+		push.AppKey = cfg.OPPO.AppKey
+		push.MasterKey = cfg.OPPO.MasterKey
+		push.PushType = cfg.OPPO.PushType
+		push.BaseURL = cfg.OPPO.BaseURL
 		appPush.OPPush = push
 	case PlatformVIVO:
 		push := newVIVOPush()
-		push.AppKey = VIVOAppKey
-		push.AppId = VIVOAppId
-		push.AppSecretKey = VIVOAppSecret
+		push.AppKey = cfg.VIVO.AppKey
+		push.AppId = cfg.VIVO.AppId
+		push.AppSecretKey = cfg.VIVO.AppSecret
+		push.BaseURL = cfg.VIVO.BaseURL
 		appPush.VOPush = push
 	case PlatformMEIZU:
 		push := newMeiZuPush()
-		push.AppKey = MZAppKey
-		push.AppId = MZAppId
+		push.AppKey = cfg.MeiZu.AppKey
+		push.AppId = cfg.MeiZu.AppId
+		push.BaseURL = cfg.MeiZu.BaseURL
 		appPush.MZPush = push
 	default:
 		push := newXMPush()
-		if len(push.AppPkgName) == 0 {
-			push.AppPkgName = AppPkgName
-		}
-		if len(push.AppSecret) == 0 {
-			push.AppSecret = XMAppSecret
-		}
-		if push.DeviceType == DeviceNil {
-			push.DeviceType = Device
-		}
+		push.AppPkgName = cfg.AppPkgName
+		push.AppSecret = cfg.XiaoMi.AppSecret
+		push.DeviceType = cfg.Device
+		push.Env = cfg.XiaoMi.Env
+		push.BaseURL = cfg.XiaoMi.BaseURL
 		appPush.XMPush = push
 	}
-	appPush.Provider = c
-	return appPush
+	appPush.Provider = cfg.Provider
+	appPush.Device = cfg.Device
+	appPush.Logger = cfg.Logger
+	appPush.cfg = cfg
+	opts := appPush.clientOptions()
+	opts.Logger = cfg.Logger
+	opts.HTTPClient = cfg.HTTPClient
+	if opts.HTTPClient == nil {
+		opts.HTTPClient = NewHTTPClient(httpOpts)
+	}
+	opts.Retry = cfg.Retry
+	if cfg.Retry.MaxAttempts == 0 {
+		opts.Retry = DefaultRetryPolicy()
+	}
+	if cfg.RateLimit.enabled() {
+		opts.RateLimiter = NewRateLimiter(cfg.RateLimit)
+	}
+	if cfg.Breaker.enabled() {
+		opts.Breaker = NewCircuitBreaker(cfg.Breaker)
+	}
+	opts.Metrics = cfg.Metrics
+	opts.Tracer = cfg.Tracer
+	opts.TokenStore = cfg.TokenStore
+	return
 }
 
-func (c *AppPush) Push(title, content string, extras map[string]string, tokens []string) (err error) {
+// Reload validates cfg and switches c to a vendor client built from it, e.g.
+// after a secret rotation. Pushes in flight finish with the previous client.
+// Options installed through the setters stay in place. The rate limiter and
+// circuit breaker keep their state while their config is unchanged, and the
+// cached access token is kept while the credentials are.
+func (c *AppPush) Reload(cfg Config) (err error) {
+	if err = cfg.Validate(); err != nil {
+		return
+	}
+	n, err := newAppPush(cfg)
+	if err != nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	prev, opts := c.clientOptions(), n.clientOptions()
+	prev.mu.RLock()
+	if reflect.DeepEqual(c.cfg.RateLimit, cfg.RateLimit) {
+		opts.RateLimiter = prev.RateLimiter
+	}
+	if sameBreakerConfig(c.cfg.Breaker, cfg.Breaker) {
+		opts.Breaker = prev.Breaker
+	}
+	prev.mu.RUnlock()
+	for _, set := range c.setters {
+		set(opts)
+	}
+	if c.cfg.credentials() == cfg.credentials() {
+		if p := n.tokenProvider(); p != nil {
+			p.seed(c.tokenProvider().Current())
+		}
+	}
+	c.Provider, c.Device, c.Logger, c.cfg = n.Provider, n.Device, opts.Logger, cfg
+	c.HWPush, c.XMPush, c.OPPush, c.VOPush, c.MZPush = n.HWPush, n.XMPush, n.OPPush, n.VOPush, n.MZPush
+	return
+}
+
+// sameBreakerConfig compares the callbacks by identity, func values are not
+// comparable otherwise.
+func sameBreakerConfig(a, b BreakerConfig) bool {
+	same := reflect.ValueOf(a.OnStateChange).Pointer() == reflect.ValueOf(b.OnStateChange).Pointer()
+	a.OnStateChange, b.OnStateChange = nil, nil
+	return same && reflect.DeepEqual(a, b)
+}
+
+// tokenProvider returns the access token cache of the active vendor client,
+// nil for vendors signing every request. c.mu must be held.
+func (c *AppPush) tokenProvider() *AccessTokenProvider {
+	switch {
+	case c.HWPush != nil:
+		return c.HWPush.tokenProvider()
+	case c.OPPush != nil:
+		return c.OPPush.tokenProvider()
+	case c.VOPush != nil:
+		return c.VOPush.tokenProvider()
+	}
+	return nil
+}
+
+// snapshot returns a copy of c that a concurrent Reload does not change.
+func (c *AppPush) snapshot() *AppPush {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return &AppPush{
+		Provider: c.Provider,
+		Device:   c.Device,
+		HWPush:   c.HWPush,
+		XMPush:   c.XMPush,
+		OPPush:   c.OPPush,
+		VOPush:   c.VOPush,
+		MZPush:   c.MZPush,
+		Logger:   c.Logger,
+	}
+}
+
+// options returns the request settings of the active vendor client.
+func (c *AppPush) options() *ClientOptions {
+	return c.snapshot().clientOptions()
+}
+
+// clientOptions is options for callers holding c.mu.
+func (c *AppPush) clientOptions() *ClientOptions {
+	switch {
+	case c.HWPush != nil:
+		return &c.HWPush.ClientOptions
+	case c.OPPush != nil:
+		return &c.OPPush.ClientOptions
+	case c.VOPush != nil:
+		return &c.VOPush.ClientOptions
+	case c.MZPush != nil:
+		return &c.MZPush.ClientOptions
+	case c.XMPush != nil:
+		return &c.XMPush.ClientOptions
+	}
+	return &ClientOptions{}
+}
+
+// SetLogger sets the logger of the AppPush and of its vendor client.
+func (c *AppPush) SetLogger(l Logger) {
+	c.set("logger", func(o *ClientOptions) { o.Logger = l })
+}
+
+// SetHTTPClient sets the http.Client used by the vendor client, including
+// for token requests.
+func (c *AppPush) SetHTTPClient(client *http.Client) {
+	c.set("http_client", func(o *ClientOptions) { o.HTTPClient = client })
+}
+
+func (c *AppPush) SetRetryPolicy(policy RetryPolicy) {
+	c.set("retry", func(o *ClientOptions) { o.Retry = policy })
+}
+
+func (c *AppPush) SetRateLimiter(l *RateLimiter) {
+	c.set("rate_limiter", func(o *ClientOptions) { o.RateLimiter = l })
+}
+
+func (c *AppPush) SetCircuitBreaker(cb *CircuitBreaker) {
+	c.set("breaker", func(o *ClientOptions) { o.Breaker = cb })
+}
+
+func (c *AppPush) SetMetrics(m Metrics) {
+	c.set("metrics", func(o *ClientOptions) { o.Metrics = m })
+}
+
+func (c *AppPush) SetTracerProvider(tp trace.TracerProvider) {
+	c.set("tracer", func(o *ClientOptions) { o.Tracer = tp })
+}
+
+// SetTokenStore shares the access token of Huawei, OPPO and VIVO clients
+// through s. It has to be called before the first push, the store is read
+// once when the first token is needed.
+func (c *AppPush) SetTokenStore(s TokenStore) {
+	c.set("token_store", func(o *ClientOptions) { o.TokenStore = s })
+}
+
+// set changes an option of the active vendor client and remembers it, so
+// that it overrides the Config passed to Reload.
+func (c *AppPush) set(name string, fn func(o *ClientOptions)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.setters == nil {
+		c.setters = make(map[string]func(*ClientOptions))
+	}
+	c.setters[name] = fn
+	opts := c.clientOptions()
+	opts.update(fn)
+	c.Logger = opts.logger() // c.Logger mirrors the option for SetLogger
+}
+
+func (c *AppPush) Push(title, content string, extras map[string]string, tokens []string) (result *PushResult, err error) {
+	return c.PushWithContext(context.Background(), title, content, extras, tokens)
+}
+
+func (c *AppPush) PushWithContext(ctx context.Context, title, content string, extras map[string]string, tokens []string) (result *PushResult, err error) {
+	msg := &Message{
+		Title:  title,
+		Body:   content,
+		Extras: extras,
+	}
+	return c.PushMessage(ctx, msg, tokens)
+}
+
+func (c *AppPush) PushMessage(ctx context.Context, msg *Message, tokens []string) (result *PushResult, err error) {
+	c = c.snapshot()
+	opts := c.options()
+	ctx, span := startSpan(ctx, opts.tracer(), "push "+c.Provider.String(), trace.SpanKindInternal,
+		attribute.String("push.vendor", c.Provider.String()),
+		attribute.Int("push.tokens", len(tokens)))
+	defer func() {
+		span.end(err)
+	}()
 	switch c.Provider {
 	case PlatformXIAOMI:
-		err = c.XMPush.push(title, content, extras, tokens)
+		result, err = c.XMPush.push(ctx, msg, tokens)
 	case PlatformHUAWEI:
-		err = c.HWPush.push(title, content, extras, tokens)
+		result, err = c.HWPush.push(ctx, msg, tokens)
 	case PlatformOPPO:
-		err = c.OPPush.push(title, content, extras, tokens)
+		result, err = c.OPPush.push(ctx, msg, tokens)
 	case PlatformVIVO:
-		err = c.VOPush.push(title, content, extras, tokens)
+		result, err = c.VOPush.push(ctx, msg, tokens)
 	case PlatformMEIZU:
-		err = c.MZPush.push(title, content, extras, tokens)
+		result, err = c.MZPush.push(ctx, msg, tokens)
 	default:
-		err = c.XMPush.push(title, content, extras, tokens)
+		result, err = c.XMPush.push(ctx, msg, tokens)
+	}
+	if result != nil {
+		metrics := opts.metrics()
+		messageIds := make([]string, 0, len(result.Batches))
+		taskIds := make([]string, 0, len(result.Batches))
+		for _, b := range result.Batches {
+			if len(b.Tokens) > 0 {
+				metrics.TokensSent(c.Provider, b.Endpoint, len(b.Tokens), len(b.Accepted))
+			}
+			if len(b.MessageId) > 0 {
+				messageIds = append(messageIds, b.MessageId)
+			}
+			if len(b.TaskId) > 0 {
+				taskIds = append(taskIds, b.TaskId)
+			}
+		}
+		span.set(attribute.Int("push.batches", len(result.Batches)),
+			attribute.Int("push.accepted", len(result.Accepted())),
+			attribute.Int("push.rejected", len(result.Rejected())),
+			attribute.StringSlice("push.message_ids", messageIds),
+			attribute.StringSlice("push.task_ids", taskIds))
+	}
+	if err != nil {
+		logTo(c.Logger, ctx, LogLevelError, "push failed", F("provider", c.Provider.String()), F("tokens", len(tokens)), F("err", err))
 	}
-	fmt.Printf("AppPushPushErr:%v\n", err)
 	return
 }
@@ -0,0 +1,67 @@
+package go_app_push
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReloadKeepsStateAndSetters(t *testing.T) {
+	var tokenFetches int32
+	vendor := newVendorServer()
+	defer vendor.Close()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "oauth2") {
+			atomic.AddInt32(&tokenFetches, 1)
+		}
+		vendor.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	cfg := vendorConfigs(srv.URL)[1]
+	cfg.RateLimit = RateLimitConfig{Default: Rate{QPS: 1000, Burst: 10}}
+	client, err := NewAppPushWithConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := NewMemoryMetrics()
+	breaker := NewCircuitBreaker(BreakerConfig{ConsecutiveFailures: 5})
+	client.SetMetrics(metrics)
+	client.SetCircuitBreaker(breaker)
+	limiter := client.options().RateLimiter
+	push := func() {
+		if _, err := client.PushMessage(context.Background(), &Message{Title: "t", Body: "b"}, []string{"a"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	push()
+
+	cfg.HTTP.Timeout = 5 * time.Second
+	if err = client.Reload(cfg); err != nil {
+		t.Fatal(err)
+	}
+	opts := client.options()
+	if opts.Metrics != metrics || opts.Breaker != breaker || opts.RateLimiter != limiter {
+		t.Error("options not carried over")
+	}
+	push()
+	if n := atomic.LoadInt32(&tokenFetches); n != 1 {
+		t.Errorf("token fetches = %d, want 1", n)
+	}
+
+	cfg.HuaWei.ClientSecret = "rotated"
+	cfg.RateLimit.Default.QPS = 500
+	if err = client.Reload(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if client.options().RateLimiter == limiter {
+		t.Error("rate limiter kept after its config changed")
+	}
+	push()
+	if n := atomic.LoadInt32(&tokenFetches); n != 2 {
+		t.Errorf("token fetches = %d, want 2", n)
+	}
+}
@@ -3,13 +3,16 @@
 package go_app_push
 
 import (
+	"context"
 	"crypto/md5"
 	"encoding/hex"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"github.com/google/go-querystring/query"
+	"net/url"
+	"strconv"
 	"strings"
+	"time"
 )
 
 const (
@@ -23,6 +26,17 @@ const (
 	PRO_API_MZ_MSG_STATICS           string = "/ups/api/server/push/statistics/dailyPushStatics"
 )
 
+// mzErrCategories maps Meizu codes to error categories.
+var mzErrCategories = map[string]ErrorCategory{
+	"1001":   ErrorCategoryTransient,      //系统错误
+	"1003":   ErrorCategoryTransient,      //服务器忙
+	"1005":   ErrorCategoryPayloadInvalid, //参数错误
+	"1006":   ErrorCategoryAuthFailed,     //签名认证失败
+	"110000": ErrorCategoryAuthFailed,     //appId不合法
+	"110001": ErrorCategoryAuthFailed,     //appKey不合法
+	"110010": ErrorCategoryQuotaExceeded,  //推送消息数量超过限制
+}
+
 type MeiZuResponse struct {
 	Code     int    `json:"code"`
 	Msg      string `json:"message"`
@@ -38,9 +52,10 @@ type MeiZuResponse struct {
 }
 
 type MeiZuPush struct {
-	AppId  int
-	AppKey string
-	Notify MeiZuNotify
+	AppId   int
+	AppKey  string
+	BaseURL string // replaces PRO_API_MZ_PREFIX when set
+	ClientOptions
 }
 
 type PushTimeInfo struct {
@@ -70,7 +85,7 @@ type MeiZuMsgNotification struct {
 		ClearNoticeBar      int    `json:"clearNoticeBar,omitempty"`
 		FixDisplay          int    `json:"fixDisplay,omitempty"`
 		FixStartDisplayTime string `json:"fixStartDisplayTime,omitempty"` //0000-00-00 00:00:00
-		FixEndDisplayTime   string `json:"fixStartDisplayTime,omitempty"` //0000-00-00 00:00:00
+		FixEndDisplayTime   string `json:"fixEndDisplayTime,omitempty"`   //0000-00-00 00:00:00
 		NotificationType    struct {
 			Vibrate int `json:"vibrate,omitempty"`
 			Lights  int `json:"lights,omitempty"`
@@ -105,26 +120,60 @@ func (mz *MeiZuPush) buildReq(url string) (req *PushReq, err error) {
 		return
 	}
 	req = newPushReq()
+	mz.apply(req, PlatformMEIZU, url)
+	req.Check = mz.check
 	req.Headers = make(map[string]string, 0)
 	req.Headers["Content-Type"] = "application/x-www-form-urlencoded;charset=UTF-8"
 	req.Method = "POST"
-	req.Url = fmt.Sprintf("%s%s", PRO_API_MZ_PREFIX, url)
+	req.Url = endpointURL(mz.BaseURL, PRO_API_MZ_PREFIX, url)
 	return
 }
 
-func (mz *MeiZuPush) PushBroadCast() (resp MeiZuResponse, err error) {
-	req, err := mz.buildReq(PRO_API_MZ_MSG_NOTIFY_ALL)
+func (mz *MeiZuPush) PushBroadCast(notify MeiZuNotify) (resp MeiZuResponse, err error) {
+	return mz.PushBroadCastWithContext(context.Background(), notify)
+}
+
+func (mz *MeiZuPush) PushBroadCastWithContext(ctx context.Context, notify MeiZuNotify) (resp MeiZuResponse, err error) {
+	batch := &BatchResult{Endpoint: PRO_API_MZ_MSG_NOTIFY_ALL}
+	return mz.send(ctx, notify, batch)
+}
+
+func (mz *MeiZuPush) PushUniBatchCast(notify MeiZuNotify) (resp MeiZuResponse, err error) {
+	return mz.PushUniBatchCastWithContext(context.Background(), notify)
+}
+
+func (mz *MeiZuPush) PushUniBatchCastWithContext(ctx context.Context, notify MeiZuNotify) (resp MeiZuResponse, err error) {
+	batch := &BatchResult{Endpoint: PRO_API_MZ_MSG_NOTIFY_ALIAS}
+	if len(notify.Alias) > 0 {
+		batch.Tokens = strings.Split(notify.Alias, ",")
+	}
+	return mz.send(ctx, notify, batch)
+}
+
+func (mz *MeiZuPush) send(ctx context.Context, notify MeiZuNotify, batch *BatchResult) (resp MeiZuResponse, err error) {
+	defer func() {
+		batch.done(err)
+	}()
+	req, err := mz.buildReq(batch.Endpoint)
 	if err != nil {
 		return
 	}
-	v, _ := json.Marshal(mz.Notify.MsgNotification)
-	mz.Notify.MessageJson = string(v)
-	queryVal, _ := query.Values(mz.Notify)
-	mz.sign(queryVal.Encode())
-	queryVal, _ = query.Values(mz.Notify)
+	if len(notify.AppId) == 0 {
+		notify.AppId = strconv.Itoa(mz.AppId)
+	}
+	notify.Sign = ""
+	v, _ := json.Marshal(notify.MsgNotification)
+	notify.MessageJson = string(v)
+	queryVal, _ := query.Values(notify)
+	queryStr := queryVal.Encode()
+	if batch.Endpoint == PRO_API_MZ_MSG_NOTIFY_ALIAS {
+		queryStr = strings.Replace(queryStr, "pushType=0", "", -1) //unset pushType
+	}
+	notify.Sign = mz.sign(queryStr)
+	queryVal, _ = query.Values(notify)
 	postBodyStr := queryVal.Encode()
 	req.Body = []byte(postBodyStr)
-	body, _, _, err := req.doPushRequest()
+	body, err := req.send(ctx, batch)
 	if err != nil {
 		return
 	}
@@ -132,82 +181,147 @@ func (mz *MeiZuPush) PushBroadCast() (resp MeiZuResponse, err error) {
 	if err != nil {
 		return
 	}
-	if resp.Code != 200 {
-		err = errors.New(resp.Msg)
-		return
+	batch.Code = strconv.Itoa(resp.Code)
+	batch.MessageId = resp.Data.MsgId
+	if resp.Data.TaskId > 0 {
+		batch.TaskId = strconv.Itoa(resp.Data.TaskId)
 	}
+	var rejected []string
+	for code, targets := range resp.Data.RespTarget {
+		if code != "200" {
+			rejected = append(rejected, targets...)
+		}
+	}
+	batch.settle(rejected)
 	return
 }
 
-func (mz *MeiZuPush) PushUniBatchCast() (resp MeiZuResponse, err error) {
-	req, err := mz.buildReq(PRO_API_MZ_MSG_NOTIFY_ALIAS)
-	if err != nil {
+func (mz *MeiZuPush) check(body []byte) (err error) {
+	resp := MeiZuResponse{}
+	if err = json.Unmarshal(body, &resp); err != nil {
 		return
 	}
-	v, _ := json.Marshal(mz.Notify.MsgNotification)
-	mz.Notify.MessageJson = string(v)
-	queryVal, _ := query.Values(mz.Notify)
-	queryStr := queryVal.Encode()
-	queryStr = strings.Replace(queryStr, "pushType=0", "", -1) //unset pushType
-	mz.sign(queryStr)
-	queryVal, _ = query.Values(mz.Notify)
-	postBodyStr := queryVal.Encode()
-	req.Body = []byte(postBodyStr)
-	body, _, _, err := req.doPushRequest()
-	if err != nil {
-		return
+	if resp.Code != 200 {
+		err = newVendorErr(PlatformMEIZU, strconv.Itoa(resp.Code), resp.Msg)
 	}
-	err = json.Unmarshal(body, &resp)
+	return
+}
+
+// Verify reads today's push statistics with a signed request, which checks
+// the app id and the app key.
+func (mz *MeiZuPush) Verify(ctx context.Context) (report *VerifyReport, err error) {
+	report = newVerifyReport(PlatformMEIZU, PRO_API_MZ_MSG_STATICS)
+	req, err := mz.buildReq(PRO_API_MZ_MSG_STATICS)
 	if err != nil {
+		report.Err = err
 		return
 	}
-	if resp.Code != 200 {
-		err = errors.New(resp.Msg)
+	today := time.Now().Format("20060102")
+	v := url.Values{}
+	v.Set("appId", strconv.Itoa(mz.AppId))
+	v.Set("startTime", today)
+	v.Set("endTime", today)
+	v.Set("sign", mz.sign(v.Encode()))
+	req.Method = "GET"
+	req.Url = fmt.Sprintf("%s?%s", req.Url, v.Encode())
+	req.Check = func(body []byte) (err error) {
+		resp := struct {
+			Code int    `json:"code"`
+			Msg  string `json:"message"`
+		}{}
+		if err = json.Unmarshal(body, &resp); err != nil {
+			return
+		}
+		if resp.Code != 200 {
+			err = newVendorErr(PlatformMEIZU, strconv.Itoa(resp.Code), resp.Msg)
+		}
 		return
 	}
+	start := time.Now()
+	_, _, header, err := req.doPushRequest(ctx)
+	err = report.observe(start, header, AccessToken{}, err)
 	return
 }
 
-func (mz *MeiZuPush) push(title, content string, extras map[string]string, tokens []string) (err error) {
-	mz.Notify.MsgNotification.NoticeBarInfo.Title = title
-	mz.Notify.MsgNotification.NoticeBarInfo.Content = content
-	mz.Notify.MsgNotification.ClickTypeInfo.ClickType = 0
-	if len(extras) > 0 {
-		extraBytArr, _ := json.Marshal(extras)
-		mz.Notify.MsgNotification.ClickTypeInfo.Parameters = string(extraBytArr)
+func (mz *MeiZuPush) applyMessage(msg *Message) (notify MeiZuNotify, warnings []string) {
+	w := &messageWarnings{provider: PlatformMEIZU}
+	notification := &notify.MsgNotification
+	notification.NoticeBarInfo.Title = msg.Title
+	notification.NoticeBarInfo.Content = msg.Body
+	switch msg.ClickAction.Type {
+	case ClickActionUrl:
+		notification.ClickTypeInfo.ClickType = 2
+		notification.ClickTypeInfo.Url = msg.ClickAction.Url
+	case ClickActionActivity:
+		notification.ClickTypeInfo.ClickType = 1
+		notification.ClickTypeInfo.Activity = msg.ClickAction.Activity
+	case ClickActionIntent:
+		notification.ClickTypeInfo.ClickType = 2
+		notification.ClickTypeInfo.Url = msg.ClickAction.Intent
+	default:
+		notification.ClickTypeInfo.ClickType = 0
+	}
+	if len(msg.Extras) > 0 {
+		extraBytArr, _ := json.Marshal(msg.Extras)
+		notification.ClickTypeInfo.Parameters = string(extraBytArr)
+	}
+	if msg.TTL > 0 {
+		//有效时长1-72小时
+		hours := int(msg.TTL / time.Hour)
+		if hours < 1 {
+			hours = 1
+		} else if hours > 72 {
+			hours = 72
+		}
+		if time.Duration(hours)*time.Hour != msg.TTL {
+			w.add("ttl %s is rounded to %d hours", msg.TTL, hours)
+		}
+		notification.PushTimeInfo.Offline = 1
+		notification.PushTimeInfo.ValidTime = hours
 	}
+	if len(msg.Sound) > 0 {
+		notification.AdvanceInfo.NotificationType.Sound = 1
+		w.add("custom sound %q is not supported, the default sound is used", msg.Sound)
+	}
+	w.unsupported("subtitle", len(msg.SubTitle) > 0)
+	w.unsupported("badge", msg.Badge > 0)
+	w.unsupported("channel id", len(msg.ChannelId) > 0)
+	w.unsupported("image", len(msg.ImageUrl) > 0)
+	w.unsupported("collapse key", len(msg.CollapseKey) > 0)
+	warnings = w.list
+	return
+}
+
+func (mz *MeiZuPush) push(ctx context.Context, msg *Message, tokens []string) (result *PushResult, err error) {
+	result = newPushResult(PlatformMEIZU)
+	notify, warnings := mz.applyMessage(msg)
+	result.Warnings = warnings
 	if len(tokens) == 0 {
-		_, err = mz.PushBroadCast()
+		batch := &BatchResult{Endpoint: PRO_API_MZ_MSG_NOTIFY_ALL}
+		mz.send(ctx, notify, batch)
+		result.add(batch)
 	} else {
-		if len(tokens) > 1000 {
-			reqLengthMod := len(tokens) % 1000
-			reqLoop := len(tokens) / 1000
-			if reqLoop > 0 {
-				for i := 0; i < reqLoop; i++ {
-					start := i * 1000
-					tmpTokens := tokens[start : start+1000]
-					_, err = mz.buildBatchPush(tmpTokens)
-				}
-			}
-			if reqLengthMod > 0 {
-				leftTokens := tokens[reqLoop*1000:]
-				_, err = mz.buildBatchPush(leftTokens)
+		for _, chunk := range splitTokens(tokens, 1000) {
+			if err = ctx.Err(); err != nil {
+				return
 			}
-		} else {
-			_, err = mz.buildBatchPush(tokens)
+			batch := &BatchResult{Endpoint: PRO_API_MZ_MSG_NOTIFY_ALIAS, Tokens: chunk}
+			mz.buildBatchPush(ctx, notify, batch)
+			result.add(batch)
 		}
 	}
+	err = result.Err()
 	return
 }
 
-func (mz *MeiZuPush) buildBatchPush(tokens []string) (resp MeiZuResponse, err error) {
-	mz.Notify.Alias = strings.Join(tokens, ",")
-	return mz.PushUniBatchCast()
+func (mz *MeiZuPush) buildBatchPush(ctx context.Context, notify MeiZuNotify, batch *BatchResult) (resp MeiZuResponse, err error) {
+	notify.Alias = strings.Join(batch.Tokens, ",")
+	return mz.send(ctx, notify, batch)
 }
 
-func (mz *MeiZuPush) sign(param string) {
+func (mz *MeiZuPush) sign(param string) string {
 	param = strings.Replace(param, "&", "", -1)
-	mz.Notify.Sign = mz.md5(fmt.Sprintf("%s%s", param, mz.AppKey))
+	return mz.md5(fmt.Sprintf("%s%s", param, mz.AppKey))
 }
 
 func (mz *MeiZuPush) md5(s string) string {
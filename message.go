@@ -0,0 +1,64 @@
+package go_app_push
+
+import (
+	"fmt"
+	"hash/fnv"
+	"time"
+)
+
+type ClickActionType uint32
+
+const (
+	ClickActionOpenApp ClickActionType = iota
+	ClickActionUrl
+	ClickActionActivity
+	ClickActionIntent
+)
+
+type ClickAction struct {
+	Type     ClickActionType
+	Url      string
+	Activity string
+	Intent   string
+}
+
+// Message is the vendor neutral notification. Every provider maps it onto its
+// own payload and reports the fields it cannot express as warnings.
+type Message struct {
+	Title       string
+	Body        string
+	SubTitle    string
+	ClickAction ClickAction
+	TTL         time.Duration
+	Sound       string
+	Badge       int
+	ChannelId   string
+	ImageUrl    string
+	CollapseKey string
+	Extras      map[string]string
+}
+
+type messageWarnings struct {
+	provider PlatformType
+	list     []string
+}
+
+func (w *messageWarnings) unsupported(field string, set bool) {
+	if set {
+		w.list = append(w.list, fmt.Sprintf("%s: %s is not supported and was ignored", w.provider, field))
+	}
+}
+
+func (w *messageWarnings) add(format string, args ...interface{}) {
+	w.list = append(w.list, fmt.Sprintf("%s: %s", w.provider, fmt.Sprintf(format, args...)))
+}
+
+func (m *Message) ttlSeconds() int {
+	return int(m.TTL / time.Second)
+}
+
+func (m *Message) collapseId() int {
+	h := fnv.New32a()
+	h.Write([]byte(m.CollapseKey))
+	return int(h.Sum32() & 0x7fffffff)
+}
@@ -0,0 +1,223 @@
+package go_app_push
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics receives the outcome of every vendor request. Implementations must
+// be safe for concurrent use.
+type Metrics interface {
+	RequestStarted(provider PlatformType, endpoint string)
+	// RequestFinished is called once per attempt, code is the vendor code of
+	// a failed request.
+	RequestFinished(provider PlatformType, endpoint string, statusCode int, code string, latency time.Duration, err error)
+	Retried(provider PlatformType, endpoint string)
+	TokensSent(provider PlatformType, endpoint string, attempted, accepted int)
+	TokenRefreshed(provider PlatformType, err error)
+}
+
+type nopMetrics struct{}
+
+func (nopMetrics) RequestStarted(provider PlatformType, endpoint string) {}
+
+func (nopMetrics) RequestFinished(provider PlatformType, endpoint string, statusCode int, code string, latency time.Duration, err error) {
+}
+
+func (nopMetrics) Retried(provider PlatformType, endpoint string) {}
+
+func (nopMetrics) TokensSent(provider PlatformType, endpoint string, attempted, accepted int) {}
+
+func (nopMetrics) TokenRefreshed(provider PlatformType, err error) {}
+
+func NopMetrics() Metrics {
+	return nopMetrics{}
+}
+
+func metricsOrNop(m Metrics) Metrics {
+	if m == nil {
+		return nopMetrics{}
+	}
+	return m
+}
+
+var defaultLatencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// MemoryMetrics keeps counters in memory and writes them in the Prometheus
+// text exposition format.
+type MemoryMetrics struct {
+	mu         sync.Mutex
+	buckets    []float64
+	counters   map[string]map[string]float64
+	gauges     map[string]map[string]float64
+	histograms map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+var metricHelp = map[string]string{
+	"push_requests_total":           "Vendor requests by status and vendor code.",
+	"push_request_errors_total":     "Failed vendor requests by error category.",
+	"push_requests_in_flight":       "Vendor requests being sent.",
+	"push_request_duration_seconds": "Latency of vendor requests.",
+	"push_retries_total":            "Vendor requests sent again after a retryable failure.",
+	"push_tokens_attempted_total":   "Device tokens sent to the vendor.",
+	"push_tokens_accepted_total":    "Device tokens accepted by the vendor.",
+	"push_token_refreshes_total":    "Access token refreshes by result.",
+}
+
+// NewMemoryMetrics uses buckets, in seconds, for the latency histogram or
+// default buckets when none are given.
+func NewMemoryMetrics(buckets ...float64) *MemoryMetrics {
+	if len(buckets) == 0 {
+		buckets = defaultLatencyBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	return &MemoryMetrics{
+		buckets:    buckets,
+		counters:   make(map[string]map[string]float64),
+		gauges:     make(map[string]map[string]float64),
+		histograms: make(map[string]*histogram),
+	}
+}
+
+func (m *MemoryMetrics) RequestStarted(provider PlatformType, endpoint string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.add(m.gauges, "push_requests_in_flight", metricLabels("vendor", provider.String(), "endpoint", endpoint), 1)
+}
+
+func (m *MemoryMetrics) RequestFinished(provider PlatformType, endpoint string, statusCode int, code string, latency time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	labels := metricLabels("vendor", provider.String(), "endpoint", endpoint)
+	m.add(m.gauges, "push_requests_in_flight", labels, -1)
+	m.add(m.counters, "push_requests_total", metricLabels("vendor", provider.String(), "endpoint", endpoint,
+		"status", strconv.Itoa(statusCode), "code", code), 1)
+	if err != nil {
+		category := "other"
+		var pe *PushError
+		if errors.As(err, &pe) {
+			category = pe.Category.String()
+		}
+		m.add(m.counters, "push_request_errors_total", metricLabels("vendor", provider.String(), "endpoint", endpoint,
+			"category", category), 1)
+	}
+	h, ok := m.histograms[labels]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(m.buckets))}
+		m.histograms[labels] = h
+	}
+	seconds := latency.Seconds()
+	for i, le := range m.buckets {
+		if seconds <= le {
+			h.counts[i]++
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+func (m *MemoryMetrics) Retried(provider PlatformType, endpoint string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.add(m.counters, "push_retries_total", metricLabels("vendor", provider.String(), "endpoint", endpoint), 1)
+}
+
+func (m *MemoryMetrics) TokensSent(provider PlatformType, endpoint string, attempted, accepted int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	labels := metricLabels("vendor", provider.String(), "endpoint", endpoint)
+	m.add(m.counters, "push_tokens_attempted_total", labels, float64(attempted))
+	m.add(m.counters, "push_tokens_accepted_total", labels, float64(accepted))
+}
+
+func (m *MemoryMetrics) TokenRefreshed(provider PlatformType, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	m.add(m.counters, "push_token_refreshes_total", metricLabels("vendor", provider.String(), "result", result), 1)
+}
+
+func (m *MemoryMetrics) add(metrics map[string]map[string]float64, name, labels string, v float64) {
+	series, ok := metrics[name]
+	if !ok {
+		series = make(map[string]float64)
+		metrics[name] = series
+	}
+	series[labels] += v
+}
+
+// WritePrometheus writes every metric in the Prometheus text format.
+func (m *MemoryMetrics) WritePrometheus(w io.Writer) (err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var b strings.Builder
+	writeSeries(&b, m.counters, "counter")
+	writeSeries(&b, m.gauges, "gauge")
+	if len(m.histograms) > 0 {
+		name := "push_request_duration_seconds"
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s histogram\n", name, metricHelp[name], name)
+		for _, labels := range sortedKeys(m.histograms) {
+			h := m.histograms[labels]
+			for i, le := range m.buckets {
+				fmt.Fprintf(&b, "%s_bucket{%s,le=\"%s\"} %d\n", name, labels, strconv.FormatFloat(le, 'g', -1, 64), h.counts[i])
+			}
+			fmt.Fprintf(&b, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, h.count)
+			fmt.Fprintf(&b, "%s_sum{%s} %s\n", name, labels, strconv.FormatFloat(h.sum, 'g', -1, 64))
+			fmt.Fprintf(&b, "%s_count{%s} %d\n", name, labels, h.count)
+		}
+	}
+	_, err = io.WriteString(w, b.String())
+	return
+}
+
+// ServeHTTP serves the metrics so MemoryMetrics can be mounted as /metrics.
+func (m *MemoryMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WritePrometheus(w)
+}
+
+func writeSeries(b *strings.Builder, metrics map[string]map[string]float64, kind string) {
+	for _, name := range sortedKeys(metrics) {
+		fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, metricHelp[name], name, kind)
+		series := metrics[name]
+		for _, labels := range sortedKeys(series) {
+			fmt.Fprintf(b, "%s{%s} %s\n", name, labels, strconv.FormatFloat(series[labels], 'g', -1, 64))
+		}
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func metricLabels(kv ...string) string {
+	pairs := make([]string, 0, len(kv)/2)
+	for i := 0; i+1 < len(kv); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, kv[i], labelEscaper.Replace(kv[i+1])))
+	}
+	return strings.Join(pairs, ",")
+}
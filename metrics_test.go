@@ -0,0 +1,88 @@
+package go_app_push
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMemoryMetricsText(t *testing.T) {
+	m := NewMemoryMetrics(1, 0.1)
+	m.RequestStarted(PlatformXIAOMI, "/a")
+	m.RequestFinished(PlatformXIAOMI, "/a", 500, `a"b`, 200*time.Millisecond, errors.New("x"))
+	m.Retried(PlatformXIAOMI, "/a")
+	m.TokensSent(PlatformXIAOMI, "/a", 3, 2)
+	m.TokenRefreshed(PlatformOPPO, nil)
+	want := `# HELP push_request_errors_total Failed vendor requests by error category.
+# TYPE push_request_errors_total counter
+push_request_errors_total{vendor="xiaomi",endpoint="/a",category="other"} 1
+# HELP push_requests_total Vendor requests by status and vendor code.
+# TYPE push_requests_total counter
+push_requests_total{vendor="xiaomi",endpoint="/a",status="500",code="a\"b"} 1
+# HELP push_retries_total Vendor requests sent again after a retryable failure.
+# TYPE push_retries_total counter
+push_retries_total{vendor="xiaomi",endpoint="/a"} 1
+# HELP push_token_refreshes_total Access token refreshes by result.
+# TYPE push_token_refreshes_total counter
+push_token_refreshes_total{vendor="oppo",result="success"} 1
+# HELP push_tokens_accepted_total Device tokens accepted by the vendor.
+# TYPE push_tokens_accepted_total counter
+push_tokens_accepted_total{vendor="xiaomi",endpoint="/a"} 2
+# HELP push_tokens_attempted_total Device tokens sent to the vendor.
+# TYPE push_tokens_attempted_total counter
+push_tokens_attempted_total{vendor="xiaomi",endpoint="/a"} 3
+# HELP push_requests_in_flight Vendor requests being sent.
+# TYPE push_requests_in_flight gauge
+push_requests_in_flight{vendor="xiaomi",endpoint="/a"} 0
+# HELP push_request_duration_seconds Latency of vendor requests.
+# TYPE push_request_duration_seconds histogram
+push_request_duration_seconds_bucket{vendor="xiaomi",endpoint="/a",le="0.1"} 0
+push_request_duration_seconds_bucket{vendor="xiaomi",endpoint="/a",le="1"} 1
+push_request_duration_seconds_bucket{vendor="xiaomi",endpoint="/a",le="+Inf"} 1
+push_request_duration_seconds_sum{vendor="xiaomi",endpoint="/a"} 0.2
+push_request_duration_seconds_count{vendor="xiaomi",endpoint="/a"} 1
+`
+	var b strings.Builder
+	if err := m.WritePrometheus(&b); err != nil {
+		t.Fatal(err)
+	}
+	if got := b.String(); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	if rec.Body.String() != want {
+		t.Errorf("ServeHTTP body differs from WritePrometheus")
+	}
+}
+
+func TestMemoryMetricsFromPush(t *testing.T) {
+	srv := newVendorServer()
+	defer srv.Close()
+	cfg := vendorConfigs(srv.URL)[0]
+	m := NewMemoryMetrics()
+	cfg.Metrics = m
+	client, err := NewAppPushWithConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.Push("t", "b", nil, []string{"a", "b"}); err != nil {
+		t.Fatal(err)
+	}
+	var b strings.Builder
+	m.WritePrometheus(&b)
+	for _, line := range []string{
+		`push_requests_total{vendor="xiaomi",endpoint="` + PRO_API_XM_ALIAS + `",status="200",code=""} 1`,
+		`push_tokens_attempted_total{vendor="xiaomi",endpoint="` + PRO_API_XM_ALIAS + `"} 2`,
+		`push_requests_in_flight{vendor="xiaomi",endpoint="` + PRO_API_XM_ALIAS + `"} 0`,
+	} {
+		if !strings.Contains(b.String(), line+"\n") {
+			t.Errorf("missing %s in\n%s", line, b.String())
+		}
+	}
+}
@@ -1,14 +1,16 @@
 package go_app_push
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
-	"errors"
 	"fmt"
-	"github.com/golang/glog"
 	"github.com/google/go-querystring/query"
+	"net/http"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -23,6 +25,8 @@ const (
 
 type OPPOPushType uint32
 
+const oppoTokenTTL int64 = 24 * 3600 * 1000
+
 const (
 	OPPOPushTypeNil            OPPOPushType = 0
 	OPPOPushTypeAll            OPPOPushType = 1
@@ -41,18 +45,38 @@ const (
 )
 
 type OPPOPush struct {
-	AuthToken        string              `url:"-" json:"-"`
-	TokenCreatedAt   int64               `url:"-" json:"-"`
-	MasterKey        string              `url:"-" json:"-"`
-	IgnoreCheckToken bool                `url:"-" json:"-"`
-	Sign             string              `url:"sign,omitempty" json:"sign"`
-	AppKey           string              `url:"app_key,omitempty" json:"app_key"`
-	Timestamp        int64               `url:"timestamp,omitempty" json:"timestamp"`
-	Notify           OPPONotifyPayload   `url:"-" json:"-"`
-	Broadcast        BroadCastPayload    `url:"-" json:"-"`
-	Unicast          UniCastPayload      `url:"-" json:"-"`
-	UniBatchcast     UniBatchCastPayload `url:"-" json:"-"`
-	PushType         OPPOPushType        `url:"-" json:"-"`
+	MasterKey string
+	AppKey    string
+	PushType  OPPOPushType
+	BaseURL   string // replaces PRO_API_OPPO_PREFIX when set
+	ClientOptions
+	tokenOnce sync.Once
+	tokens    *AccessTokenProvider
+}
+
+type OPPOAuthPayload struct {
+	Sign      string `url:"sign,omitempty" json:"sign"`
+	AppKey    string `url:"app_key,omitempty" json:"app_key"`
+	Timestamp int64  `url:"timestamp,omitempty" json:"timestamp"`
+}
+
+// opErrCategories maps OPPO codes to error categories.
+var opErrCategories = map[string]ErrorCategory{
+	"-2":    ErrorCategoryRateLimited,    //服务器流量控制
+	"-1":    ErrorCategoryTransient,      //服务不可用
+	"11":    ErrorCategoryAuthFailed,     //不合法的AuthToken
+	"13":    ErrorCategoryQuotaExceeded,  //应用调用次数超限
+	"14":    ErrorCategoryAuthFailed,     //无效的AppKey
+	"16":    ErrorCategoryAuthFailed,     //无效的签名
+	"26":    ErrorCategoryAuthFailed,     //IP黑名单
+	"27":    ErrorCategoryAuthFailed,     //拒绝访问
+	"28":    ErrorCategoryAuthFailed,     //应用不可用
+	"29":    ErrorCategoryAuthFailed,     //缺少AuthToken
+	"30":    ErrorCategoryAuthFailed,     //API无权限
+	"33":    ErrorCategoryQuotaExceeded,  //消息条数超过日限额
+	"40":    ErrorCategoryPayloadInvalid, //缺少必选参数
+	"41":    ErrorCategoryPayloadInvalid, //非法的参数
+	"10000": ErrorCategoryInvalidToken,   //无效的RegistrationId
 }
 
 type OPPOCommonResponse struct {
@@ -61,6 +85,12 @@ type OPPOCommonResponse struct {
 	Data    map[string]interface{} `json:"data,omitempty"`
 }
 
+type OPPOBatchResponse struct {
+	Code    int                      `json:"code,omitempty"`
+	Message string                   `json:"message,omitempty"`
+	Data    []map[string]interface{} `json:"data,omitempty"`
+}
+
 type OPPOBroadCastResponse struct {
 	Code    int                    `json:"code,omitempty"`
 	Message string                 `json:"message,omitempty"`
@@ -113,78 +143,123 @@ type OPPONotifyPayload struct {
 	NetWorkType         int           `url:"net_work_type,omitempty" json:"net_work_type,omitempty"`
 	CallBackUrl         string        `url:"call_back_url,omitempty" json:"call_back_url,omitempty"`
 	CallBackParameter   string        `url:"call_back_parameter,omitempty" json:"call_back_parameter,omitempty"`
+	ChannelId           string        `url:"channel_id,omitempty" json:"channel_id,omitempty"`
 }
 
 func newOPPOPush() *OPPOPush {
 	return new(OPPOPush)
 }
 
+// Verify requests an auth token signed with the master secret, so both the
+// app key and the master secret are checked. A valid cached token is
+// reported instead.
+func (op *OPPOPush) Verify(ctx context.Context) (report *VerifyReport, err error) {
+	return op.verify(ctx, false)
+}
+
+// VerifyFresh is Verify, but always requests a new auth token.
+func (op *OPPOPush) VerifyFresh(ctx context.Context) (report *VerifyReport, err error) {
+	return op.verify(ctx, true)
+}
+
+func (op *OPPOPush) verify(ctx context.Context, force bool) (report *VerifyReport, err error) {
+	report = newVerifyReport(PlatformOPPO, PRO_API_OPPO_SUBFIX_TOKEN)
+	start := time.Now()
+	_, header, err := report.token(ctx, op.tokenProvider(), force, func(ctx context.Context) (token AccessToken, header http.Header, err error) {
+		if token, header, err = op.fetchToken(ctx); err == nil && token.CreatedAt > 0 {
+			report.clock(time.UnixMilli(token.CreatedAt), start)
+		}
+		op.stampCreated(&token)
+		return
+	})
+	// the token lifetime is computed locally, OPPO does not return it
+	err = report.observe(start, header, AccessToken{}, err)
+	report.hint("auth token lifetime of 24h is documented, not returned by %s", PlatformOPPO)
+	report.hint("package name is not checked by the auth endpoint")
+	return
+}
+
 /**
  * check oppo api token
  */
-func (op *OPPOPush) checkTokenExpired() {
-	if op.TokenCreatedAt+86400000 < op.ms() {
-		op.IgnoreCheckToken = true
-		err := op.getToken()
-		glog.Info("checkTokenExpired----op.getTokenErr:%v\n", err)
-	}
+func (op *OPPOPush) tokenProvider() *AccessTokenProvider {
+	op.tokenOnce.Do(func() {
+		op.tokens = newTokenProvider(PlatformOPPO, op.AppKey, &op.ClientOptions, op.getToken)
+	})
+	return op.tokens
+}
+
+func (op *OPPOPush) checkTokenExpired(ctx context.Context) (authToken string, err error) {
+	return op.tokenProvider().Token(ctx)
 }
 
 /**
  * get oppo api token
  */
-func (op *OPPOPush) getToken() (err error) {
-	op.sign()
-	req, err := op.buildReq(PRO_API_OPPO_SUBFIX_TOKEN)
+func (op *OPPOPush) getToken(ctx context.Context) (accessToken AccessToken, err error) {
+	accessToken, _, err = op.fetchToken(ctx)
+	op.stampCreated(&accessToken)
+	return
+}
+
+// stampCreated sets a missing create_time to the local time.
+func (op *OPPOPush) stampCreated(accessToken *AccessToken) {
+	if len(accessToken.Token) > 0 && accessToken.CreatedAt == 0 {
+		accessToken.CreatedAt = op.ms()
+	}
+}
+
+// fetchToken leaves CreatedAt 0 when OPPO returns no create_time.
+func (op *OPPOPush) fetchToken(ctx context.Context) (accessToken AccessToken, header http.Header, err error) {
+	req, err := op.newReq(PRO_API_OPPO_SUBFIX_TOKEN)
 	if err != nil {
 		return
 	}
-	v, _ := query.Values(op)
+	v, _ := query.Values(op.sign())
 	req.Body = []byte(v.Encode())
-	body, statusCode, _, err := req.doPushRequest()
-	// fmt.Printf("body:%v\n", string(body))
-	// fmt.Printf("statusCode:%v\n", statusCode)
-	// fmt.Printf("getTokenStatusCodeErr:%v\n", err)
-	if statusCode != 200 {
-		return
-	}
-	// fmt.Printf("req.doPushRequestErr:%v\n", err)
+	body, _, header, err := req.doPushRequest(ctx)
 	if err != nil {
 		return
 	}
-	resp := OPPOCommonResponse{}
+	resp := struct {
+		Data struct {
+			AuthToken  string `json:"auth_token"`
+			CreateTime int64  `json:"create_time"`
+		} `json:"data"`
+	}{}
 	err = json.Unmarshal(body, &resp)
-	// fmt.Printf("OPPOCommonResponseResp:%v\n", resp)
-	// fmt.Printf("OPPOCommonResponseRespErr:%v\n", err)
 	if err != nil {
 		return
 	}
-	if resp.Code > 0 {
-		err = errors.New(resp.Message)
-		return
-	}
-	// fmt.Printf("getTokenResp:%v\n", resp)
-	//op.AuthToken, ok1 := resp.Data["auth_token"].(string)
-	if atoken, ok1 := resp.Data["auth_token"].(string); ok1 {
-		op.AuthToken = atoken
-	}
-	if ctime, ok2 := resp.Data["create_time"].(int64); ok2 {
-		op.TokenCreatedAt = ctime
-	}
-	op.IgnoreCheckToken = false
-	// fmt.Printf("OPPOPushGetTokenOPPOresp.Data------->:%v\n", resp)
-	// fmt.Printf("OPPOPushGetTokenOPPO------->:%v\n", op)
+	//auth_token有效期24小时,过期时间按本地时间计算以免受时钟偏差影响
+	accessToken.Token = resp.Data.AuthToken
+	accessToken.CreatedAt = resp.Data.CreateTime
+	accessToken.ExpiresAt = op.ms() + oppoTokenTTL
+	return
+}
+
+func (op *OPPOPush) SaveNotifyToOPPO(notify OPPONotifyPayload) (msgId string, err error) {
+	return op.SaveNotifyToOPPOWithContext(context.Background(), notify)
+}
+
+func (op *OPPOPush) SaveNotifyToOPPOWithContext(ctx context.Context, notify OPPONotifyPayload) (msgId string, err error) {
+	batch := &BatchResult{Endpoint: PRO_API_OPPO_SUBFIX_SAVE}
+	err = op.saveNotify(ctx, notify, batch)
+	msgId = batch.MessageId
 	return
 }
 
-func (op *OPPOPush) SaveNotifyToOPPO() (msgId string, err error) {
-	req, err := op.buildReq(PRO_API_OPPO_SUBFIX_SAVE)
+func (op *OPPOPush) saveNotify(ctx context.Context, notify OPPONotifyPayload, batch *BatchResult) (err error) {
+	defer func() {
+		batch.done(err)
+	}()
+	req, err := op.buildReq(ctx, PRO_API_OPPO_SUBFIX_SAVE)
 	if err != nil {
 		return
 	}
-	v, _ := query.Values(op.Notify)
+	v, _ := query.Values(notify)
 	req.Body = []byte(v.Encode())
-	body, _, _, err := req.doPushRequest()
+	body, err := req.send(ctx, batch)
 	if err != nil {
 		return
 	}
@@ -193,27 +268,44 @@ func (op *OPPOPush) SaveNotifyToOPPO() (msgId string, err error) {
 	if err != nil {
 		return
 	}
-	if resp.Code > 0 {
-		err = errors.New(resp.Message)
-		return
-	}
+	batch.Code = strconv.Itoa(resp.Code)
 	if msgIdVal, ok := resp.Data["message_id"].(string); ok {
-		msgId = msgIdVal
+		batch.MessageId = msgIdVal
 	}
 	return
 }
 
-func (op *OPPOPush) PushBroadCast() (msgId, taskId string, err error) {
-	msgId, _ = op.SaveNotifyToOPPO()
-	req, err := op.buildReq(PRO_API_OPPO_SUBFIX_BROADCAST)
+func (op *OPPOPush) PushBroadCast(notify OPPONotifyPayload) (msgId, taskId string, err error) {
+	return op.PushBroadCastWithContext(context.Background(), notify)
+}
+
+func (op *OPPOPush) PushBroadCastWithContext(ctx context.Context, notify OPPONotifyPayload) (msgId, taskId string, err error) {
+	save := &BatchResult{Endpoint: PRO_API_OPPO_SUBFIX_SAVE}
+	if err = op.saveNotify(ctx, notify, save); err != nil {
+		return
+	}
+	batch := &BatchResult{Endpoint: PRO_API_OPPO_SUBFIX_BROADCAST}
+	err = op.pushBroadCast(ctx, save.MessageId, batch)
+	msgId = batch.MessageId
+	taskId = batch.TaskId
+	return
+}
+
+func (op *OPPOPush) pushBroadCast(ctx context.Context, msgId string, batch *BatchResult) (err error) {
+	defer func() {
+		batch.done(err)
+	}()
+	req, err := op.buildReq(ctx, PRO_API_OPPO_SUBFIX_BROADCAST)
 	if err != nil {
 		return
 	}
-	op.Broadcast.MessageId = msgId
-	op.Broadcast.TargetType = OPPOPushTypeAll
-	v, _ := query.Values(op.Broadcast)
+	broadcast := BroadCastPayload{
+		MessageId:  msgId,
+		TargetType: OPPOPushTypeAll,
+	}
+	v, _ := query.Values(broadcast)
 	req.Body = []byte(v.Encode())
-	body, _, _, err := req.doPushRequest()
+	body, err := req.send(ctx, batch)
 	if err != nil {
 		return
 	}
@@ -222,27 +314,36 @@ func (op *OPPOPush) PushBroadCast() (msgId, taskId string, err error) {
 	if err != nil {
 		return
 	}
-	if resp.Code > 0 {
-		err = errors.New(resp.Message)
-		return
+	batch.Code = strconv.Itoa(resp.Code)
+	batch.MessageId = msgId
+	if msgIdVal, ok := resp.Data["message_id"].(string); ok {
+		batch.MessageId = msgIdVal
 	}
-	if len(resp.Data) > 2 {
-		for k, v := range resp.Data {
-			if k == "message_id" {
-				msgId = v.(string)
-			} else if k == "task_id" {
-				taskId = v.(string)
-			}
-		}
-	} else {
-		msgId = resp.Data["message_id"].(string)
-		taskId = resp.Data["task_id"].(string)
+	if taskIdVal, ok := resp.Data["task_id"].(string); ok {
+		batch.TaskId = taskIdVal
 	}
 	return
 }
 
-func (op *OPPOPush) PushUniCast() (msgId string, err error) {
-	req, err := op.buildReq(PRO_API_OPPO_SUBFIX_UNICAST)
+func (op *OPPOPush) PushUniCast(notify OPPONotifyPayload, target string) (msgId string, err error) {
+	return op.PushUniCastWithContext(context.Background(), notify, target)
+}
+
+func (op *OPPOPush) PushUniCastWithContext(ctx context.Context, notify OPPONotifyPayload, target string) (msgId string, err error) {
+	batch := &BatchResult{Endpoint: PRO_API_OPPO_SUBFIX_UNICAST}
+	if len(target) > 0 {
+		batch.Tokens = []string{target}
+	}
+	err = op.pushUniCast(ctx, notify, batch)
+	msgId = batch.MessageId
+	return
+}
+
+func (op *OPPOPush) pushUniCast(ctx context.Context, notify OPPONotifyPayload, batch *BatchResult) (err error) {
+	defer func() {
+		batch.done(err)
+	}()
+	req, err := op.buildReq(ctx, PRO_API_OPPO_SUBFIX_UNICAST)
 	if err != nil {
 		return
 	}
@@ -250,45 +351,17 @@ func (op *OPPOPush) PushUniCast() (msgId string, err error) {
 		err = OPPOMissingPushTypeErr
 		return
 	}
-	var tmpActionParams string
-	if len(op.Notify.ActionParameters) > 0 {
-		tmpActionParams = op.Notify.ActionParameters
-		op.Notify.ActionParameters = "--aparams--"
-		// fmt.Printf("tmpActionParams:%s\n\n", tmpActionParams)
-	}
-	op.Unicast.Payload.Notify = op.Notify
-	if len(op.Unicast.Payload.TargetValue) == 0 {
+	if len(batch.Tokens) == 0 {
 		err = OPPOMissingDeviceErr
 		return
 	}
-	if op.Unicast.Payload.TargetType == 0 {
-		op.Unicast.Payload.TargetType = 3
-	}
-	notifyByteArr, _ := json.Marshal(op.Unicast.Payload.Notify)
-	notifyStr := string(notifyByteArr)
-	// fmt.Printf("notifyStr:%s\n", notifyStr)
-
-	op.Unicast.Payload.Notification = "--notify--"
-	notifyPayloadByteArr, _ := json.Marshal(op.Unicast.Payload)
-
-	notifyPayloadStr := string(notifyPayloadByteArr)
-
-	// fmt.Printf("notifyPayloadByteArr:%s\n", notifyPayloadStr)
-
-	op.Unicast.Message = strings.Replace(notifyPayloadStr, "\"--notify--\"", notifyStr, -1)
-
-	if len(op.Notify.ActionParameters) > 0 {
-		op.Unicast.Message = strings.Replace(op.Unicast.Message, "\"--aparams--\"", tmpActionParams, -1)
-	}
-
-	// fmt.Printf("op.Unicast.Message---->:%s\n\n", op.Unicast.Message)
-
-	v, _ := query.Values(op.Unicast)
-
+	unicast := UniCastPayload{}
+	unicast.Payload.TargetType = op.PushType
+	unicast.Payload.TargetValue = batch.Tokens[0]
+	unicast.Message = op.encodeMessage(notify, unicast.Payload)
+	v, _ := query.Values(unicast)
 	req.Body = []byte(v.Encode())
-
-	// fmt.Printf("OPPOPushPushUniCast--req--->:%v\n", req)
-	body, _, _, err := req.doPushRequest()
+	body, err := req.send(ctx, batch)
 	if err != nil {
 		return
 	}
@@ -297,115 +370,166 @@ func (op *OPPOPush) PushUniCast() (msgId string, err error) {
 	if err != nil {
 		return
 	}
-	if resp.Code > 0 {
-		err = errors.New(resp.Message)
-		return
-	}
-	//msgId = resp.Data["messageId"]
+	batch.Code = strconv.Itoa(resp.Code)
 	if msgIdVal, ok := resp.Data["messageId"].(string); ok {
-		msgId = msgIdVal
+		batch.MessageId = msgIdVal
 	}
-	// fmt.Printf("PushUniCast---msgId----->:%s\n", msgId)
+	batch.settle(nil)
 	return
 }
 
-func (op *OPPOPush) PushUniBatchCast() (msgId string, err error) {
-	req, err := op.buildReq(PRO_API_OPPO_SUBFIX_UNICASTBATCH)
+func (op *OPPOPush) PushUniBatchCast(notify OPPONotifyPayload, targets []string) (msgId string, err error) {
+	return op.PushUniBatchCastWithContext(context.Background(), notify, targets)
+}
+
+func (op *OPPOPush) PushUniBatchCastWithContext(ctx context.Context, notify OPPONotifyPayload, targets []string) (msgId string, err error) {
+	batch := &BatchResult{Endpoint: PRO_API_OPPO_SUBFIX_UNICASTBATCH, Tokens: targets}
+	err = op.pushUniBatchCast(ctx, notify, batch)
+	msgId = batch.MessageId
+	return
+}
+
+func (op *OPPOPush) pushUniBatchCast(ctx context.Context, notify OPPONotifyPayload, batch *BatchResult) (err error) {
+	defer func() {
+		batch.done(err)
+	}()
+	req, err := op.buildReq(ctx, PRO_API_OPPO_SUBFIX_UNICASTBATCH)
 	if err != nil {
 		return
 	}
-	if len(op.UniBatchcast.Payload) == 0 {
+	if op.PushType == OPPOPushTypeNil {
+		err = OPPOMissingPushTypeErr
 		return
 	}
-	var notifyActionParamsStr string
-	if len(op.Notify.ActionParameters) > 0 {
-		notifyActionParamsStr = op.Notify.ActionParameters
-		op.Notify.ActionParameters = "--aprams--"
-	}
-
-	tmpPayloadNotifiesStr := make(map[string]string, 0)
-	for index, payload := range op.UniBatchcast.Payload {
-		payload.Notify = op.Notify
-		tmpNotifyByteArr, _ := json.Marshal(payload.Notify)
-		tmpNotifyStr := string(tmpNotifyByteArr)
-		keyStr := fmt.Sprintf("--%d-notify--", index)
-		tmpPayloadNotifiesStr[keyStr] = tmpNotifyStr
-		op.UniBatchcast.Payload[index].Notification = keyStr
-	}
-	uniBatchCastByteArr, _ := json.Marshal(op.UniBatchcast.Payload)
-	batchCastStr := string(uniBatchCastByteArr)
-
-	for index, _ := range op.UniBatchcast.Payload {
-		keyStr := fmt.Sprintf("--%d-notify--", index)
-		keyReplaceStr := fmt.Sprintf("\"--%d-notify--\"", index)
-		batchCastStr = strings.Replace(batchCastStr, keyReplaceStr, tmpPayloadNotifiesStr[keyStr], -1)
+	if len(batch.Tokens) == 0 {
+		return
 	}
-	if len(notifyActionParamsStr) > 0 {
-		batchCastStr = strings.Replace(batchCastStr, "\"--aprams--\"", notifyActionParamsStr, -1)
+	messages := make([]string, 0, len(batch.Tokens))
+	for _, token := range batch.Tokens {
+		target := UniCastPayloadBody{
+			TargetType:  op.PushType,
+			TargetValue: token,
+		}
+		messages = append(messages, op.encodeMessage(notify, target))
 	}
-	op.UniBatchcast.Message = batchCastStr
-	v, _ := query.Values(op.UniBatchcast)
+	uniBatchcast := UniBatchCastPayload{}
+	uniBatchcast.Message = fmt.Sprintf("[%s]", strings.Join(messages, ","))
+	v, _ := query.Values(uniBatchcast)
 	req.Body = []byte(v.Encode())
-	body, _, _, err := req.doPushRequest()
+	body, err := req.send(ctx, batch)
 	if err != nil {
 		return
 	}
-	resp := OPPOCommonResponse{}
+	resp := OPPOBatchResponse{}
 	err = json.Unmarshal(body, &resp)
 	if err != nil {
 		return
 	}
-	if resp.Code > 0 {
-		err = errors.New(resp.Message)
-		return
+	batch.Code = strconv.Itoa(resp.Code)
+	var rejected []string
+	for _, item := range resp.Data {
+		target, _ := item["registrationId"].(string)
+		if len(target) == 0 {
+			target, _ = item["targetValue"].(string)
+		}
+		if _, failed := item["errorCode"]; failed {
+			rejected = append(rejected, target)
+			continue
+		}
+		if msgIdVal, ok := item["messageId"].(string); ok && len(batch.MessageId) == 0 {
+			batch.MessageId = msgIdVal
+		}
 	}
-	//msgId = resp.Data["messageId"]
-	if msgIdVal, ok := resp.Data["messageId"].(string); ok {
-		msgId = msgIdVal
+	batch.settle(rejected)
+	return
+}
+
+// encodeMessage embeds the notification and its action parameters as raw
+// json objects instead of json strings.
+func (op *OPPOPush) encodeMessage(notify OPPONotifyPayload, target UniCastPayloadBody) string {
+	var actionParams string
+	if len(notify.ActionParameters) > 0 {
+		actionParams = notify.ActionParameters
+		notify.ActionParameters = "--aparams--"
 	}
+	notifyByteArr, _ := json.Marshal(notify)
+	notifyStr := string(notifyByteArr)
+	if len(actionParams) > 0 {
+		notifyStr = strings.Replace(notifyStr, "\"--aparams--\"", actionParams, -1)
+	}
+	target.Notification = "--notify--"
+	targetByteArr, _ := json.Marshal(target)
+	return strings.Replace(string(targetByteArr), "\"--notify--\"", notifyStr, -1)
+}
+
+func (op *OPPOPush) applyMessage(msg *Message) (notify OPPONotifyPayload, warnings []string) {
+	w := &messageWarnings{provider: PlatformOPPO}
+	notify.Title = msg.Title
+	notify.SubTitle = msg.SubTitle
+	notify.Content = msg.Body
+	switch msg.ClickAction.Type {
+	case ClickActionUrl:
+		notify.ClickActionType = OPPOClickTypeWeb
+		notify.ClickActionUrl = msg.ClickAction.Url
+	case ClickActionActivity:
+		notify.ClickActionType = OPPOClickTypeActivity
+		notify.ClickActionActivity = msg.ClickAction.Activity
+	case ClickActionIntent:
+		notify.ClickActionType = OPPOClickTypeSchemeUrl
+		notify.ClickActionUrl = msg.ClickAction.Intent
+	default:
+		notify.ClickActionType = OPPOClickTypeStartup
+	}
+	if len(msg.Extras) > 0 {
+		extrasBytArr, _ := json.Marshal(msg.Extras)
+		notify.ActionParameters = string(extrasBytArr)
+	}
+	notify.OffLine = msg.TTL > 0
+	notify.OffLineTtl = msg.ttlSeconds()
+	notify.ChannelId = msg.ChannelId
+	w.unsupported("sound", len(msg.Sound) > 0)
+	w.unsupported("badge", msg.Badge > 0)
+	w.unsupported("image", len(msg.ImageUrl) > 0)
+	w.unsupported("collapse key", len(msg.CollapseKey) > 0)
+	warnings = w.list
 	return
 }
 
 /**
  * start push action
  */
-func (op *OPPOPush) push(title, content string, extras map[string]string, tokens []string) (err error) {
-	op.Notify.Title = title
-	op.Notify.Content = content
-	if len(extras) > 0 {
-		extrasBytArr, _ := json.Marshal(extras)
-		op.Notify.ActionParameters = string(extrasBytArr)
-	}
+func (op *OPPOPush) push(ctx context.Context, msg *Message, tokens []string) (result *PushResult, err error) {
+	result = newPushResult(PlatformOPPO)
+	notify, warnings := op.applyMessage(msg)
+	result.Warnings = warnings
 	if len(tokens) == 0 {
-		_, _, err = op.PushBroadCast()
+		save := &BatchResult{Endpoint: PRO_API_OPPO_SUBFIX_SAVE}
+		op.saveNotify(ctx, notify, save)
+		result.add(save)
+		if save.Err == nil {
+			batch := &BatchResult{Endpoint: PRO_API_OPPO_SUBFIX_BROADCAST}
+			op.pushBroadCast(ctx, save.MessageId, batch)
+			result.add(batch)
+		}
 	} else if len(tokens) > 1 {
-		if len(tokens) > 1000 {
-			reqLengthMod := len(tokens) % 1000
-			reqLoop := len(tokens) / 1000
-			if reqLoop > 0 {
-				for i := 0; i < reqLoop; i++ {
-					start := i * 1000
-					tmpTokens := tokens[start : start+1000]
-					_, err = op.buildBatchPush(tmpTokens)
-				}
-			}
-			if reqLengthMod > 0 {
-				leftTokens := tokens[reqLoop*1000:]
-				_, err = op.buildBatchPush(leftTokens)
+		for _, chunk := range splitTokens(tokens, 1000) {
+			if err = ctx.Err(); err != nil {
+				return
 			}
-		} else {
-			_, err = op.buildBatchPush(tokens)
+			batch := &BatchResult{Endpoint: PRO_API_OPPO_SUBFIX_UNICASTBATCH, Tokens: chunk}
+			op.pushUniBatchCast(ctx, notify, batch)
+			result.add(batch)
 		}
 	} else if len(tokens) == 1 {
-		//op.Unicast.Payload.TargetType = OPPOPushTypeAlias
-		op.Unicast.Payload.TargetType = op.PushType
-		op.Unicast.Payload.TargetValue = tokens[0]
-		_, err = op.PushUniCast()
+		batch := &BatchResult{Endpoint: PRO_API_OPPO_SUBFIX_UNICAST, Tokens: tokens}
+		op.pushUniCast(ctx, notify, batch)
+		result.add(batch)
 	}
+	err = result.Err()
 	return
 }
 
-func (op *OPPOPush) buildReq(queryPath string) (req *PushReq, err error) {
+func (op *OPPOPush) newReq(queryPath string) (req *PushReq, err error) {
 	if len(op.AppKey) == 0 {
 		err = MissingAppKeyErr
 		return
@@ -414,41 +538,54 @@ func (op *OPPOPush) buildReq(queryPath string) (req *PushReq, err error) {
 		err = OPPOMissingMasterKeyErr
 		return
 	}
-	if !op.IgnoreCheckToken {
-		op.checkTokenExpired()
-	}
 	req = newPushReq()
+	op.apply(req, PlatformOPPO, queryPath)
+	req.Check = op.check
 	req.Headers = make(map[string]string, 0)
-	req.Headers["auth_token"] = op.AuthToken
 	req.Method = "POST"
-	req.Url = fmt.Sprintf("%s%s", PRO_API_OPPO_PREFIX, queryPath)
-	// glog.Infof("OPPOPush) buildReq---->req:%v\n", req)
+	req.Url = endpointURL(op.BaseURL, PRO_API_OPPO_PREFIX, queryPath)
 	return
 }
 
-func (op *OPPOPush) buildBatchPush(tokens []string) (msgId string, err error) {
-	if op.PushType == OPPOPushTypeNil {
-		err = OPPOMissingPushTypeErr
+func (op *OPPOPush) buildReq(ctx context.Context, queryPath string) (req *PushReq, err error) {
+	req, err = op.newReq(queryPath)
+	if err != nil {
+		return
+	}
+	req.Headers["auth_token"], err = op.checkTokenExpired(ctx)
+	req.Expired = op.authExpired
+	req.Reauth = func(ctx context.Context) (err error) {
+		req.Headers["auth_token"], err = op.tokenProvider().Renew(ctx, req.Headers["auth_token"])
+		return
+	}
+	return
+}
+
+// authExpired reports code 11, an auth_token that is invalid or expired.
+func (op *OPPOPush) authExpired(header http.Header, err error) bool {
+	return vendorCode(err) == "11"
+}
+
+func (op *OPPOPush) check(body []byte) (err error) {
+	resp := struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	}{}
+	if err = json.Unmarshal(body, &resp); err != nil {
 		return
 	}
-	op.UniBatchcast.Payload = make([]UniCastPayloadBody, 0, 0)
-	for _, token := range tokens {
-		p := UniCastPayloadBody{}
-		p.Notify = op.Notify
-		//p.TargetType = OPPOPushTypeAlias
-		p.TargetType = op.PushType
-		p.TargetValue = token
-		op.UniBatchcast.Payload = append(op.UniBatchcast.Payload, p)
+	if resp.Code != 0 {
+		err = newVendorErr(PlatformOPPO, strconv.Itoa(resp.Code), resp.Message)
 	}
-	return op.PushUniBatchCast()
+	return
 }
 
-func (op *OPPOPush) sign() {
-	op.Timestamp = op.ms()
-	signStr := fmt.Sprintf("%s%d%s", op.AppKey, op.Timestamp, op.MasterKey)
-	// fmt.Printf("OPPOPushBeforeSignStr:%s", signStr)
-	op.Sign = op.sha256(signStr)
-	// fmt.Printf("OPPOPushSignStr:%s\n", op.Sign)
+func (op *OPPOPush) sign() (auth OPPOAuthPayload) {
+	auth.AppKey = op.AppKey
+	auth.Timestamp = op.ms()
+	signStr := fmt.Sprintf("%s%d%s", op.AppKey, auth.Timestamp, op.MasterKey)
+	auth.Sign = op.sha256(signStr)
+	return
 }
 
 func (op *OPPOPush) ms() int64 {
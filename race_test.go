@@ -0,0 +1,91 @@
+package go_app_push
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newVendorServer answers every vendor endpoint with a success response.
+func newVendorServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := r.URL.Path
+		switch {
+		case strings.Contains(p, "oauth2"):
+			fmt.Fprint(w, `{"access_token":"hwtok","expires_in":3600}`)
+		case strings.Contains(p, "pushsend"):
+			fmt.Fprint(w, `{"code":"80000000","msg":"ok","requestId":"r1"}`)
+		case p == "/auth":
+			fmt.Fprintf(w, `{"code":0,"data":{"auth_token":"optok","create_time":%d}}`, time.Now().UnixMilli())
+		case strings.HasPrefix(p, "/message/notification"):
+			if strings.Contains(p, "unicast_batch") {
+				fmt.Fprint(w, `{"code":0,"data":[{"messageId":"m1","registrationId":"a"}]}`)
+				return
+			}
+			fmt.Fprint(w, `{"code":0,"data":{"message_id":"m1","task_id":"t1","messageId":"m1"}}`)
+		case strings.HasPrefix(p, "/message/"):
+			fmt.Fprint(w, `{"result":0,"desc":"ok","authToken":"votok","taskId":"t1"}`)
+		case strings.HasPrefix(p, "/ups/"):
+			fmt.Fprint(w, `{"code":200,"message":"ok","value":{"msgId":"m1"}}`)
+		default:
+			fmt.Fprint(w, `{"result":"ok","code":0,"data":{"id":"x1"}}`)
+		}
+	}))
+}
+
+func vendorConfigs(baseURL string) []Config {
+	return []Config{
+		{Provider: PlatformXIAOMI, AppPkgName: "p", Device: DeviceANDROID, XiaoMi: XiaoMiConfig{AppSecret: "s", BaseURL: baseURL}},
+		{Provider: PlatformHUAWEI, AppPkgName: "p", HuaWei: HuaWeiConfig{ClientId: "c", ClientSecret: "s", AuthBaseURL: baseURL, BaseURL: baseURL}},
+		{Provider: PlatformOPPO, OPPO: OPPOConfig{AppKey: "k", MasterKey: "m", PushType: OPPOPushTypeRegistrationId, BaseURL: baseURL}},
+		{Provider: PlatformVIVO, VIVO: VIVOConfig{AppId: 1, AppKey: "k", AppSecret: "s", BaseURL: baseURL}},
+		{Provider: PlatformMEIZU, MeiZu: MeiZuConfig{AppId: 1, AppKey: "k", BaseURL: baseURL}},
+	}
+}
+
+// TestConcurrentPush shares one client per vendor between goroutines, while
+// the setters run. Run it with -race.
+func TestConcurrentPush(t *testing.T) {
+	srv := newVendorServer()
+	defer srv.Close()
+	for _, cfg := range vendorConfigs(srv.URL) {
+		client, err := NewAppPushWithConfig(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				tokens := []string{"a", "b"}
+				if i%2 == 0 {
+					tokens = tokens[:1]
+				}
+				msg := &Message{Title: fmt.Sprint("t", i), Body: "b", Extras: map[string]string{"k": "v"}}
+				result, err := client.PushMessage(context.Background(), msg, tokens)
+				if err != nil {
+					t.Errorf("%s: %v", cfg.Provider, err)
+					return
+				}
+				if len(result.Batches) == 0 {
+					t.Errorf("%s: no batches", cfg.Provider)
+				}
+			}(i)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client.SetMetrics(NopMetrics())
+			client.SetLogger(nil)
+			client.SetRetryPolicy(DefaultRetryPolicy())
+			client.SetTracerProvider(nil)
+		}()
+		wg.Wait()
+	}
+}
@@ -0,0 +1,191 @@
+package go_app_push
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// EndpointKind groups vendor endpoints that share a rate budget.
+type EndpointKind int
+
+const (
+	EndpointUnknown EndpointKind = iota
+	EndpointAuth
+	EndpointSave
+	EndpointUniCast
+	EndpointUniBatchCast
+	EndpointBroadCast
+)
+
+func (k EndpointKind) String() string {
+	switch k {
+	case EndpointAuth:
+		return "auth"
+	case EndpointSave:
+		return "save"
+	case EndpointUniCast:
+		return "unicast"
+	case EndpointUniBatchCast:
+		return "batch"
+	case EndpointBroadCast:
+		return "broadcast"
+	}
+	return "unknown"
+}
+
+var endpointKinds = map[string]EndpointKind{
+	PRO_API_XM_ACCOUNT:               EndpointUniBatchCast,
+	PRO_API_XM_ALIAS:                 EndpointUniBatchCast,
+	PRO_API_XM_TOPIC:                 EndpointBroadCast,
+	PRO_API_XM_MTOPIC:                EndpointBroadCast,
+	PRO_API_XM_ALL:                   EndpointBroadCast,
+	PRO_API_HW_TOKEN:                 EndpointAuth,
+	PRO_API_HW_SEND:                  EndpointUniBatchCast,
+	PRO_API_OPPO_SUBFIX_TOKEN:        EndpointAuth,
+	PRO_API_OPPO_SUBFIX_SAVE:         EndpointSave,
+	PRO_API_OPPO_SUBFIX_BROADCAST:    EndpointBroadCast,
+	PRO_API_OPPO_SUBFIX_UNICAST:      EndpointUniCast,
+	PRO_API_OPPO_SUBFIX_UNICASTBATCH: EndpointUniBatchCast,
+	PRO_API_VIVO_SUBFIX_TOKEN:        EndpointAuth,
+	PRO_API_VIVO_SUBFIX_SAVE:         EndpointSave,
+	PRO_API_VIVO_SUBFIX_BROADCAST:    EndpointBroadCast,
+	PRO_API_VIVO_SUBFIX_UNICAST:      EndpointUniCast,
+	PRO_API_VIVO_SUBFIX_UNICASTBATCH: EndpointUniBatchCast,
+	PRO_API_MZ_MSG_TRANSPARENT:       EndpointUniBatchCast,
+	PRO_API_MZ_MSG_NOTIFY:            EndpointUniBatchCast,
+	PRO_API_MZ_MSG_TRANSPARENT_ALIAS: EndpointUniBatchCast,
+	PRO_API_MZ_MSG_NOTIFY_ALIAS:      EndpointUniBatchCast,
+	PRO_API_MZ_MSG_NOTIFY_ALL:        EndpointBroadCast,
+}
+
+func endpointKind(endpoint string) EndpointKind {
+	return endpointKinds[endpoint]
+}
+
+type RateLimitPolicy int
+
+const (
+	RateLimitWait     RateLimitPolicy = iota // block until the budget allows the request or ctx is done
+	RateLimitFailFast                        // return a rate limited PushError at once
+)
+
+// Rate is a token bucket: QPS requests per second with bursts of Burst.
+// A zero QPS means no limit.
+type Rate struct {
+	QPS   float64
+	Burst int
+}
+
+type RateLimitConfig struct {
+	Policy    RateLimitPolicy
+	Default   Rate // used for kinds missing from Endpoints
+	Endpoints map[EndpointKind]Rate
+}
+
+func (c RateLimitConfig) enabled() bool {
+	if c.Default.QPS > 0 {
+		return true
+	}
+	for _, rate := range c.Endpoints {
+		if rate.QPS > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// RateLimiter holds the QPS budgets of one vendor app. Share one RateLimiter
+// between clients that push for the same app.
+type RateLimiter struct {
+	cfg     RateLimitConfig
+	mu      sync.Mutex
+	buckets map[EndpointKind]*bucket
+}
+
+func NewRateLimiter(cfg RateLimitConfig) *RateLimiter {
+	return &RateLimiter{cfg: cfg, buckets: make(map[EndpointKind]*bucket)}
+}
+
+// Wait takes one request from the budget of kind, following the policy.
+func (l *RateLimiter) Wait(ctx context.Context, kind EndpointKind) (err error) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	b := l.bucket(kind)
+	var delay time.Duration
+	ok := true
+	if b != nil {
+		delay, ok = b.take(time.Now(), l.cfg.Policy == RateLimitWait)
+	}
+	l.mu.Unlock()
+	if !ok {
+		err = LocalRateLimitErr
+		return
+	}
+	if delay <= 0 {
+		return
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		err = ctx.Err()
+		l.mu.Lock()
+		b.put()
+		l.mu.Unlock()
+	case <-timer.C:
+	}
+	return
+}
+
+func (l *RateLimiter) bucket(kind EndpointKind) *bucket {
+	if b, ok := l.buckets[kind]; ok {
+		return b
+	}
+	rate, ok := l.cfg.Endpoints[kind]
+	if !ok {
+		rate = l.cfg.Default
+	}
+	var b *bucket
+	if rate.QPS > 0 {
+		burst := float64(rate.Burst)
+		if burst < 1 {
+			burst = 1
+		}
+		b = &bucket{qps: rate.QPS, burst: burst, tokens: burst, last: time.Now()}
+	}
+	l.buckets[kind] = b
+	return b
+}
+
+type bucket struct {
+	qps    float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// take removes one token. With reserve the token may be borrowed from the
+// future and the returned delay is how long the caller has to wait for it.
+func (b *bucket) take(now time.Time, reserve bool) (delay time.Duration, ok bool) {
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.qps)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0, true
+	}
+	if !reserve {
+		return 0, false
+	}
+	delay = time.Duration((1 - b.tokens) / b.qps * float64(time.Second))
+	b.tokens--
+	return delay, true
+}
+
+// put gives back a token reserved by take that will not be used.
+func (b *bucket) put() {
+	b.tokens = math.Min(b.burst, b.tokens+1)
+}
@@ -0,0 +1,74 @@
+package go_app_push
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRateLimitFailFast(t *testing.T) {
+	l := NewRateLimiter(RateLimitConfig{
+		Policy:    RateLimitFailFast,
+		Default:   Rate{QPS: 1, Burst: 2},
+		Endpoints: map[EndpointKind]Rate{EndpointAuth: {}},
+	})
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if err := l.Wait(ctx, EndpointUniCast); err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+	}
+	if err := l.Wait(ctx, EndpointUniCast); !errors.Is(err, LocalRateLimitErr) {
+		t.Errorf("err = %v, want LocalRateLimitErr", err)
+	}
+	// kinds have their own budget, a zero QPS is not limited
+	if err := l.Wait(ctx, EndpointBroadCast); err != nil {
+		t.Errorf("broadcast: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := l.Wait(ctx, EndpointAuth); err != nil {
+			t.Fatalf("auth %d: %v", i, err)
+		}
+	}
+	var none *RateLimiter
+	if err := none.Wait(ctx, EndpointUniCast); err != nil {
+		t.Errorf("nil limiter: %v", err)
+	}
+}
+
+func TestRateLimitWait(t *testing.T) {
+	l := NewRateLimiter(RateLimitConfig{Policy: RateLimitWait, Default: Rate{QPS: 20}})
+	ctx := context.Background()
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := l.Wait(ctx, EndpointUniCast); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := time.Since(start); d < 90*time.Millisecond {
+		t.Errorf("3 requests at 20 qps took %v, want about 100ms", d)
+	}
+}
+
+func TestRateLimitWaitCanceled(t *testing.T) {
+	l := NewRateLimiter(RateLimitConfig{Policy: RateLimitWait, Default: Rate{QPS: 5}})
+	ctx := context.Background()
+	if err := l.Wait(ctx, EndpointUniCast); err != nil {
+		t.Fatal(err)
+	}
+	canceled, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if err := l.Wait(canceled, EndpointUniCast); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want deadline", err)
+	}
+	// the canceled request gave its token back, so this one waits one
+	// interval (200ms) and not two
+	start := time.Now()
+	if err := l.Wait(ctx, EndpointUniCast); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > 300*time.Millisecond {
+		t.Errorf("waited %v after a canceled request, want about 200ms", d)
+	}
+}
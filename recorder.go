@@ -0,0 +1,202 @@
+package go_app_push
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Exchange is one recorded vendor request and its response, stored as one
+// JSON line.
+type Exchange struct {
+	Time           time.Time   `json:"time"`
+	Method         string      `json:"method"`
+	URL            string      `json:"url"`
+	RequestHeader  http.Header `json:"request_header,omitempty"`
+	RequestBody    string      `json:"request_body,omitempty"`
+	StatusCode     int         `json:"status,omitempty"`
+	ResponseHeader http.Header `json:"response_header,omitempty"`
+	ResponseBody   string      `json:"response_body,omitempty"`
+	Error          string      `json:"error,omitempty"`
+	DurationMs     int64       `json:"duration_ms"`
+}
+
+// Recorder is an http.RoundTripper that writes every exchange it forwards to
+// Next as JSONL. Secrets in headers, bodies and URLs are redacted.
+type Recorder struct {
+	Next   http.RoundTripper // nil uses http.DefaultTransport
+	mu     sync.Mutex
+	w      io.Writer
+	closer io.Closer
+}
+
+func NewRecorder(w io.Writer, next http.RoundTripper) *Recorder {
+	return &Recorder{Next: next, w: w}
+}
+
+// NewFileRecorder appends the exchanges to the file at path.
+func NewFileRecorder(path string, next http.RoundTripper) (r *Recorder, err error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return
+	}
+	r = NewRecorder(f, next)
+	r.closer = f
+	return
+}
+
+func (r *Recorder) Close() error {
+	if r.closer == nil {
+		return nil
+	}
+	return r.closer.Close()
+}
+
+func (r *Recorder) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	ex := Exchange{
+		Time:          time.Now(),
+		Method:        req.Method,
+		URL:           Redact(req.URL.String()),
+		RequestHeader: RedactHeader(req.Header),
+	}
+	if req.GetBody != nil {
+		if body, e := req.GetBody(); e == nil {
+			b, _ := ioutil.ReadAll(body)
+			body.Close()
+			ex.RequestBody = Redact(string(b))
+		}
+	}
+	next := r.Next
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	resp, err = next.RoundTrip(req)
+	ex.DurationMs = time.Since(ex.Time).Milliseconds()
+	if err != nil {
+		ex.Error = Redact(err.Error())
+		r.write(ex)
+		return
+	}
+	b, readErr := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(b))
+	ex.StatusCode = resp.StatusCode
+	ex.ResponseHeader = RedactHeader(resp.Header)
+	ex.ResponseBody = Redact(string(b))
+	if readErr != nil {
+		ex.Error = readErr.Error()
+	}
+	r.write(ex)
+	return
+}
+
+func (r *Recorder) write(ex Exchange) {
+	line, err := json.Marshal(ex)
+	if err != nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.w.Write(append(line, '\n'))
+}
+
+// Replayer is an http.RoundTripper that answers from recorded exchanges
+// instead of calling the vendor. Requests are matched on method and URL
+// without the query, in the order they were recorded, because signed bodies
+// and request ids differ between runs.
+type Replayer struct {
+	mu    sync.Mutex
+	queue map[string][]Exchange
+}
+
+func NewReplayer(r io.Reader) (p *Replayer, err error) {
+	p = &Replayer{queue: make(map[string][]Exchange)}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		ex := Exchange{}
+		if err = json.Unmarshal(line, &ex); err != nil {
+			return
+		}
+		key := replayKey(ex.Method, ex.URL)
+		p.queue[key] = append(p.queue[key], ex)
+	}
+	err = scanner.Err()
+	return
+}
+
+func NewFileReplayer(path string) (p *Replayer, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	return NewReplayer(f)
+}
+
+func (p *Replayer) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	key := replayKey(req.Method, req.URL.String())
+	p.mu.Lock()
+	queue := p.queue[key]
+	if len(queue) == 0 {
+		p.mu.Unlock()
+		err = fmt.Errorf("%w: %s", ReplayMissErr, key)
+		return
+	}
+	ex := queue[0]
+	p.queue[key] = queue[1:]
+	p.mu.Unlock()
+	if len(ex.Error) > 0 && ex.StatusCode == 0 {
+		err = errors.New(ex.Error)
+		return
+	}
+	header := ex.ResponseHeader
+	if header == nil {
+		header = make(http.Header)
+	}
+	resp = &http.Response{
+		Status:        fmt.Sprintf("%d %s", ex.StatusCode, http.StatusText(ex.StatusCode)),
+		StatusCode:    ex.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(strings.NewReader(ex.ResponseBody)),
+		ContentLength: int64(len(ex.ResponseBody)),
+		Request:       req,
+	}
+	return
+}
+
+// Remaining returns how many recorded exchanges have not been replayed.
+func (p *Replayer) Remaining() (n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, queue := range p.queue {
+		n += len(queue)
+	}
+	return
+}
+
+func replayKey(method, rawUrl string) string {
+	if i := strings.IndexByte(rawUrl, '?'); i >= 0 {
+		rawUrl = rawUrl[:i]
+	}
+	return strings.ToUpper(method) + " " + rawUrl
+}
@@ -0,0 +1,55 @@
+package go_app_push
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	srv := newVendorServer()
+	cfg := vendorConfigs(srv.URL)[1]
+	cfg.HuaWei.ClientSecret = "hwsecret"
+	var log bytes.Buffer
+	cfg.HTTP.WrapTransport = func(next http.RoundTripper) http.RoundTripper {
+		return NewRecorder(&log, next)
+	}
+	client, err := NewAppPushWithConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.Push("t", "b", nil, []string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	srv.Close()
+	recording := log.String()
+	if n := strings.Count(recording, "\n"); n != 2 {
+		t.Fatalf("recorded %d exchanges, want the token and the push:\n%s", n, recording)
+	}
+	for _, secret := range []string{"hwsecret", "hwtok"} {
+		if strings.Contains(recording, secret) {
+			t.Errorf("recording contains %q:\n%s", secret, recording)
+		}
+	}
+
+	replayer, err := NewReplayer(strings.NewReader(recording))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.HTTP.WrapTransport = func(http.RoundTripper) http.RoundTripper { return replayer }
+	client, err = NewAppPushWithConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.Push("t", "b", nil, []string{"a"}); err != nil {
+		t.Fatalf("replayed push: %v", err)
+	}
+	if n := replayer.Remaining(); n != 0 {
+		t.Errorf("%d exchanges left", n)
+	}
+	if _, err = client.Push("t", "b", nil, []string{"a"}); !errors.Is(err, ReplayMissErr) {
+		t.Errorf("err = %v, want ReplayMissErr", err)
+	}
+}
@@ -0,0 +1,100 @@
+package go_app_push
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+const redacted = "[REDACTED]"
+
+// secretKeys are the headers, form fields and JSON keys carrying credentials
+// or signatures. They are matched without regard to case.
+var secretKeys = []string{
+	"Authorization",
+	"auth_token",
+	"authToken",
+	"access_token",
+	"client_secret",
+	"sign",
+	"appKey",
+	"app_key",
+}
+
+var (
+	secretJSONPattern = regexp.MustCompile(`(?i)("(?:` + strings.Join(secretKeys, "|") + `)"\s*:\s*)("(?:[^"\\]|\\.)*"|[^,}\]\s]+)`)
+	secretFormPattern = regexp.MustCompile(`(?i)((?:^|[?&\s])(?:` + strings.Join(secretKeys, "|") + `)=)([^&\s"]*)`)
+)
+
+// Redact replaces the values of secret JSON keys and form fields in s, so
+// request and response bodies, URLs and vendor messages can be logged.
+func Redact(s string) string {
+	if len(s) == 0 {
+		return s
+	}
+	s = secretJSONPattern.ReplaceAllString(s, `${1}"`+redacted+`"`)
+	return secretFormPattern.ReplaceAllString(s, "${1}"+redacted)
+}
+
+// RedactHeader returns a copy of h with the values of secret headers replaced.
+func RedactHeader(h http.Header) http.Header {
+	if len(h) == 0 {
+		return nil
+	}
+	out := h.Clone()
+	for key := range out {
+		if isSecretKey(key) {
+			out[key] = []string{redacted}
+		}
+	}
+	return out
+}
+
+// redactErr hides the secrets err would print, such as a signed URL in a
+// *url.Error. errors.Is and errors.As still see err.
+func redactErr(err error) error {
+	if err == nil || Redact(err.Error()) == err.Error() {
+		return err
+	}
+	return &redactedErr{err: err}
+}
+
+type redactedErr struct {
+	err error
+}
+
+func (e *redactedErr) Error() string {
+	return Redact(e.err.Error())
+}
+
+func (e *redactedErr) Unwrap() error {
+	return e.err
+}
+
+func isSecretKey(key string) bool {
+	for _, name := range secretKeys {
+		if strings.EqualFold(key, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactFields scrubs string and error values before they reach a Logger.
+func redactFields(fields []Field) []Field {
+	out := make([]Field, len(fields))
+	for i, f := range fields {
+		switch v := f.Value.(type) {
+		case string:
+			f.Value = Redact(v)
+		case []byte:
+			f.Value = Redact(string(v))
+		case error:
+			if s := v.Error(); Redact(s) != s {
+				f.Value = Redact(s)
+			}
+		}
+		out[i] = f
+	}
+	return out
+}
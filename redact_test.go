@@ -0,0 +1,52 @@
+package go_app_push
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{``, ``},
+		{`{"access_token":"abc","expires_in":3600}`, `{"access_token":"[REDACTED]","expires_in":3600}`},
+		{`{"authToken" : "a\"b","result":0}`, `{"authToken" : "[REDACTED]","result":0}`},
+		{`{"appKey":123}`, `{"appKey":"[REDACTED]"}`},
+		{`grant_type=client_credentials&client_secret=s3&client_id=1`, `grant_type=client_credentials&client_secret=[REDACTED]&client_id=1`},
+		{`https://h/api?SIGN=abc&x=1`, `https://h/api?SIGN=[REDACTED]&x=1`},
+		{`design=keep&signal=1`, `design=keep&signal=1`},
+	}
+	for _, tt := range tests {
+		if got := Redact(tt.in); got != tt.want {
+			t.Errorf("Redact(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestRedactHeader(t *testing.T) {
+	h := http.Header{"Authorization": {"Bearer x"}, "Authtoken": {"y"}, "Content-Type": {"application/json"}}
+	out := RedactHeader(h)
+	if out.Get("Authorization") != redacted || out.Get("authToken") != redacted || out.Get("Content-Type") != "application/json" {
+		t.Errorf("RedactHeader = %v", out)
+	}
+	if h.Get("Authorization") != "Bearer x" {
+		t.Error("RedactHeader changed its argument")
+	}
+}
+
+func TestRedactErr(t *testing.T) {
+	plain := errors.New("plain")
+	if redactErr(plain) != plain {
+		t.Error("an error without secrets was wrapped")
+	}
+	err := redactErr(fmt.Errorf(`Post "https://h?access_token=abc": %w`, EmptyAccessTokenErr))
+	if err.Error() != `Post "https://h?access_token=[REDACTED]": `+EmptyAccessTokenErr.Error() {
+		t.Errorf("Error() = %q", err.Error())
+	}
+	if !errors.Is(err, EmptyAccessTokenErr) {
+		t.Error("redacted error does not unwrap")
+	}
+}
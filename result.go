@@ -0,0 +1,123 @@
+package go_app_push
+
+import (
+	"errors"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// BatchResult records a single vendor request made while pushing one message.
+type BatchResult struct {
+	Index      int
+	Endpoint   string
+	MessageId  string
+	TaskId     string
+	RequestId  string
+	StatusCode int
+	Attempts   int
+	Code       string
+	Err        error
+	Tokens     []string
+	Accepted   []string
+	Rejected   []string
+	span       *pushSpan // of the last vendor call, open until done
+}
+
+// PushResult lists every vendor request made by a Push call, in order.
+type PushResult struct {
+	Provider PlatformType
+	Batches  []*BatchResult
+	Warnings []string
+}
+
+func newPushResult(provider PlatformType) *PushResult {
+	return &PushResult{Provider: provider}
+}
+
+func (r *PushResult) add(b *BatchResult) {
+	b.Index = len(r.Batches)
+	r.Batches = append(r.Batches, b)
+}
+
+// Failed returns the batches whose request did not succeed, so that only
+// those chunks need to be retried.
+func (r *PushResult) Failed() (batches []*BatchResult) {
+	for _, b := range r.Batches {
+		if b.Err != nil {
+			batches = append(batches, b)
+		}
+	}
+	return
+}
+
+// Retries returns how many requests were repeated after a retryable failure.
+func (r *PushResult) Retries() (n int) {
+	for _, b := range r.Batches {
+		if b.Attempts > 1 {
+			n += b.Attempts - 1
+		}
+	}
+	return
+}
+
+func (r *PushResult) Accepted() (tokens []string) {
+	for _, b := range r.Batches {
+		tokens = append(tokens, b.Accepted...)
+	}
+	return
+}
+
+func (r *PushResult) Rejected() (tokens []string) {
+	for _, b := range r.Batches {
+		tokens = append(tokens, b.Rejected...)
+	}
+	return
+}
+
+// Err joins the errors of all failed batches.
+func (r *PushResult) Err() error {
+	errs := make([]error, 0)
+	for _, b := range r.Batches {
+		if b.Err != nil {
+			errs = append(errs, b.Err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// done records err, the outcome of the batch, and ends the span of its last
+// vendor call with the ids parsed from the response.
+func (b *BatchResult) done(err error) {
+	b.Err = err
+	if b.span == nil {
+		return
+	}
+	if len(b.MessageId) > 0 {
+		b.span.set(attribute.String("push.message_id", b.MessageId))
+	}
+	if len(b.TaskId) > 0 {
+		b.span.set(attribute.String("push.task_id", b.TaskId))
+	}
+	if len(b.RequestId) > 0 {
+		b.span.set(attribute.String("push.request_id", b.RequestId))
+	}
+	b.span.end(nil)
+	b.span = nil
+}
+
+// settle splits the batch tokens into accepted and rejected once the vendor
+// has answered successfully.
+func (b *BatchResult) settle(rejected []string) {
+	if b.Err != nil {
+		return
+	}
+	b.Rejected = rejected
+	bad := make(map[string]bool, len(rejected))
+	for _, token := range rejected {
+		bad[token] = true
+	}
+	for _, token := range b.Tokens {
+		if !bad[token] {
+			b.Accepted = append(b.Accepted, token)
+		}
+	}
+}
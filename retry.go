@@ -0,0 +1,112 @@
+package go_app_push
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy controls how a vendor request is repeated after a retryable
+// PushError, that is a network error, a 5xx/429 status or a vendor code
+// classified as transient or rate limited.
+//
+// A push that fails after it may have reached the vendor, on a timeout or a
+// 5xx other than 503 without Retry-After, may already have been delivered.
+// Repeating it can deliver the message twice, so it is only repeated when the
+// vendor drops duplicates, which only VIVO does by requestId.
+type RetryPolicy struct {
+	MaxAttempts int           // total attempts including the first one, 0 or 1 disables retries
+	BaseDelay   time.Duration // backoff before the second attempt, default 200ms
+	MaxDelay    time.Duration // upper bound of every wait including Retry-After, default 10s
+}
+
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: 3,
+		BaseDelay:   200 * time.Millisecond,
+		MaxDelay:    10 * time.Second,
+	}
+}
+
+// backoff returns the wait before attempt+1: the Retry-After hint when the
+// vendor sent one, otherwise exponential backoff with full jitter.
+func (p RetryPolicy) backoff(attempt int, retryAfter time.Duration) time.Duration {
+	base, max := p.BaseDelay, p.MaxDelay
+	if base <= 0 {
+		base = 200 * time.Millisecond
+	}
+	if max <= 0 {
+		max = 10 * time.Second
+	}
+	if retryAfter > 0 {
+		if retryAfter > max {
+			return max
+		}
+		return retryAfter
+	}
+	delay := max
+	if attempt < 31 && base<<uint(attempt-1) < max {
+		delay = base << uint(attempt-1)
+	}
+	return time.Duration(rand.Int63n(int64(delay) + 1))
+}
+
+// wait sleeps before the next attempt, it returns false when err is not
+// retryable, the attempts are used up or ctx is done first.
+func (p RetryPolicy) wait(ctx context.Context, attempt int, err error) bool {
+	var pe *PushError
+	if attempt >= p.MaxAttempts || !errors.As(err, &pe) || !pe.Retryable() {
+		return false
+	}
+	timer := time.NewTimer(p.backoff(attempt, pe.RetryAfter))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// maybeDelivered reports a failure that may have happened after the vendor
+// accepted the push: a network failure without a response, or a 5xx. Failures
+// to connect, directly or to the proxy, are known to be undelivered, and so
+// is a 503 or any 5xx with Retry-After, the vendor turned the push away.
+func maybeDelivered(err error) bool {
+	var pe *PushError
+	if !errors.As(err, &pe) {
+		return false
+	}
+	if pe.StatusCode >= 500 {
+		return pe.StatusCode != http.StatusServiceUnavailable && pe.RetryAfter == 0
+	}
+	if pe.StatusCode != 0 || pe.Err == nil {
+		return false
+	}
+	var oe *net.OpError
+	if errors.As(pe.Err, &oe) && (oe.Op == "dial" || oe.Op == "proxyconnect") {
+		return false
+	}
+	return true
+}
+
+// parseRetryAfter reads a Retry-After header given in seconds or as an HTTP date.
+func parseRetryAfter(header http.Header) time.Duration {
+	v := header.Get("Retry-After")
+	if len(v) == 0 {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(v); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(v); err == nil {
+		if d := time.Until(at); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
@@ -0,0 +1,166 @@
+package go_app_push
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+var fastRetry = RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+
+// A timed out push may have been delivered, Xiaomi cannot drop a replay.
+func TestTimeoutNotReplayedWithoutDedup(t *testing.T) {
+	var mu sync.Mutex
+	sends := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		sends++
+		mu.Unlock()
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer srv.Close()
+	client, err := NewAppPushWithConfig(Config{
+		Provider:   PlatformXIAOMI,
+		AppPkgName: "p",
+		XiaoMi:     XiaoMiConfig{AppSecret: "s", BaseURL: srv.URL},
+		HTTP:       HTTPOptions{Timeout: 50 * time.Millisecond},
+		Retry:      fastRetry,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.Push("t", "b", nil, []string{"a"}); err == nil {
+		t.Fatal("want timeout")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if sends != 1 {
+		t.Errorf("sends = %d, want 1", sends)
+	}
+}
+
+// VIVO drops replays carrying the same requestId, so timeouts are retried.
+func TestTimeoutReplayedWithRequestId(t *testing.T) {
+	var mu sync.Mutex
+	var requestIds []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == PRO_API_VIVO_SUBFIX_TOKEN {
+			fmt.Fprint(w, `{"result":0,"desc":"ok","authToken":"votok"}`)
+			return
+		}
+		var body struct {
+			RequestId string `json:"requestId"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		mu.Lock()
+		requestIds = append(requestIds, body.RequestId)
+		mu.Unlock()
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer srv.Close()
+	client, err := NewAppPushWithConfig(Config{
+		Provider: PlatformVIVO,
+		VIVO:     VIVOConfig{AppId: 1, AppKey: "k", AppSecret: "s", BaseURL: srv.URL},
+		HTTP:     HTTPOptions{Timeout: 50 * time.Millisecond},
+		Retry:    fastRetry,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.Push("t", "b", nil, []string{"a"}); err == nil {
+		t.Fatal("want timeout")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(requestIds) != 3 || requestIds[0] == "" || requestIds[1] != requestIds[0] || requestIds[2] != requestIds[0] {
+		t.Errorf("requestIds = %q, want 3 equal ids", requestIds)
+	}
+}
+
+// A push that never connected is retried for every vendor.
+func TestConnectFailureReplayed(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	client, err := NewAppPushWithConfig(Config{
+		Provider:   PlatformXIAOMI,
+		AppPkgName: "p",
+		XiaoMi:     XiaoMiConfig{AppSecret: "s", BaseURL: "http://" + addr},
+		Retry:      fastRetry,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := client.Push("t", "b", nil, []string{"a"})
+	if err == nil || result == nil || len(result.Batches) != 1 {
+		t.Fatalf("result %+v, err %v", result, err)
+	}
+	if attempts := result.Batches[0].Attempts; attempts != 3 {
+		t.Errorf("attempts = %d, want 3", attempts)
+	}
+}
+
+// A 5xx may come after the push was accepted, only 503 and Retry-After prove
+// it was turned away. VIVO is replayed either way.
+func TestServerErrorReplay(t *testing.T) {
+	cases := []struct {
+		provider   PlatformType
+		status     int
+		retryAfter string
+		sends      int
+	}{
+		{PlatformXIAOMI, http.StatusInternalServerError, "", 1},
+		{PlatformXIAOMI, http.StatusBadGateway, "", 1},
+		{PlatformXIAOMI, http.StatusServiceUnavailable, "", 3},
+		{PlatformXIAOMI, http.StatusInternalServerError, "1", 3},
+		{PlatformXIAOMI, http.StatusTooManyRequests, "", 3},
+		{PlatformVIVO, http.StatusInternalServerError, "", 3},
+	}
+	for _, c := range cases {
+		var mu sync.Mutex
+		sends := 0
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == PRO_API_VIVO_SUBFIX_TOKEN {
+				fmt.Fprint(w, `{"result":0,"desc":"ok","authToken":"votok"}`)
+				return
+			}
+			mu.Lock()
+			sends++
+			mu.Unlock()
+			if len(c.retryAfter) > 0 {
+				w.Header().Set("Retry-After", c.retryAfter)
+			}
+			w.WriteHeader(c.status)
+		}))
+		cfg := vendorConfigs(srv.URL)[0]
+		if c.provider == PlatformVIVO {
+			cfg = vendorConfigs(srv.URL)[3]
+		}
+		cfg.Retry = fastRetry
+		client, err := NewAppPushWithConfig(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = client.Push("t", "b", nil, []string{"a"}); err == nil {
+			t.Errorf("%s %d: want error", c.provider, c.status)
+		}
+		srv.Close()
+		if sends != c.sends {
+			t.Errorf("%s %d retry-after %q: sends = %d, want %d", c.provider, c.status, c.retryAfter, sends, c.sends)
+		}
+	}
+}
+
+func TestLegacyClientSendsOnce(t *testing.T) {
+	if attempts := NewAppPush(PlatformXIAOMI).options().Retry.MaxAttempts; attempts != 1 {
+		t.Errorf("MaxAttempts = %d, want 1", attempts)
+	}
+}
@@ -0,0 +1,272 @@
+package go_app_push
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// DefaultTokenRefreshBefore is how long before expiry a token is refreshed.
+const DefaultTokenRefreshBefore = 5 * time.Minute
+
+// AccessToken is a vendor access token, times are unix milliseconds.
+type AccessToken struct {
+	Token     string `json:"token"`
+	CreatedAt int64  `json:"created_at"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+func (t AccessToken) valid(now time.Time) bool {
+	return len(t.Token) > 0 && t.ExpiresAt > now.UnixMilli()
+}
+
+// TokenFetcher requests a new access token from the vendor.
+type TokenFetcher func(ctx context.Context) (AccessToken, error)
+
+// AccessTokenProvider caches an access token and refreshes it through Fetch.
+// Concurrent callers share one refresh. A token close to expiry is refreshed
+// in the background while the current one is still handed out. With a Store,
+// a token saved by another client is used before fetching a new one.
+type AccessTokenProvider struct {
+	Fetch         TokenFetcher
+	RefreshBefore time.Duration // default DefaultTokenRefreshBefore
+	Store         TokenStore    // optional
+	Key           string        // key of the token in Store
+	Logger        Logger        // receives Store errors, which never fail a refresh
+	mu            sync.Mutex
+	token         AccessToken
+	call          *tokenCall
+}
+
+type tokenCall struct {
+	done     chan struct{}
+	rejected string // the token the refresh must not return
+	token    AccessToken
+	err      error
+}
+
+func NewAccessTokenProvider(fetch TokenFetcher) *AccessTokenProvider {
+	return &AccessTokenProvider{Fetch: fetch, RefreshBefore: DefaultTokenRefreshBefore}
+}
+
+// Token returns a valid token. It only blocks when no valid token is cached,
+// and returns the refresh error in that case.
+func (p *AccessTokenProvider) Token(ctx context.Context) (token string, err error) {
+	now := time.Now()
+	p.mu.Lock()
+	current := p.token
+	if current.valid(now.Add(p.refreshBefore(current))) {
+		p.mu.Unlock()
+		token = current.Token
+		return
+	}
+	call := p.refresh(ctx, "")
+	p.mu.Unlock()
+	if current.valid(now) {
+		token = current.Token
+		return
+	}
+	return call.wait(ctx)
+}
+
+// Renew drops rejected, a token the vendor refused before its expiry, and
+// returns a new one. Callers that saw the same token share one refresh, and
+// rejected is not taken from Store again. A refresh started without rejected
+// in mind, e.g. a proactive one, is waited for and its token checked.
+func (p *AccessTokenProvider) Renew(ctx context.Context, rejected string) (token string, err error) {
+	for {
+		p.mu.Lock()
+		if p.token.Token != rejected && p.token.valid(time.Now()) {
+			token = p.token.Token
+			p.mu.Unlock()
+			return
+		}
+		p.token = AccessToken{}
+		if call := p.call; call != nil && call.rejected != rejected {
+			p.mu.Unlock()
+			select {
+			case <-call.done:
+				continue
+			case <-ctx.Done():
+				err = ctx.Err()
+				return
+			}
+		}
+		call := p.refresh(ctx, rejected)
+		p.mu.Unlock()
+		return call.wait(ctx)
+	}
+}
+
+func (c *tokenCall) wait(ctx context.Context) (token string, err error) {
+	select {
+	case <-c.done:
+		token, err = c.token.Token, c.err
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	return
+}
+
+// seed caches t, a token fetched by a previous provider, unless a token is
+// cached already.
+func (p *AccessTokenProvider) seed(t AccessToken) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.token.Token) == 0 {
+		p.token = t
+	}
+}
+
+// cached returns a valid token from the cache or else from Store, without
+// fetching one. A stored token is cached.
+func (p *AccessTokenProvider) cached(ctx context.Context) (token AccessToken, ok bool) {
+	now := time.Now()
+	p.mu.Lock()
+	token = p.token
+	p.mu.Unlock()
+	if token.valid(now) || p.Store == nil {
+		ok = token.valid(now)
+		return
+	}
+	token, ok, err := p.Store.Get(ctx, p.Key)
+	if err != nil || !ok || !token.valid(now) {
+		return AccessToken{}, false
+	}
+	p.mu.Lock()
+	if !p.token.valid(now) {
+		p.token = token
+	}
+	p.mu.Unlock()
+	return
+}
+
+// publish caches token, fetched outside Fetch e.g. by Verify, and writes it
+// to Store so that the next push needs no fetch.
+func (p *AccessTokenProvider) publish(ctx context.Context, token AccessToken) {
+	p.mu.Lock()
+	p.token = token
+	p.mu.Unlock()
+	if p.Store == nil {
+		return
+	}
+	stored, ok, err := p.Store.Get(ctx, p.Key)
+	if err == nil {
+		if !ok {
+			stored = AccessToken{}
+		}
+		_, err = p.Store.CompareAndSwap(ctx, p.Key, stored, token, tokenTTL(token))
+	}
+	if err != nil {
+		logTo(p.Logger, ctx, LogLevelWarn, "write token store failed", F("key", p.Key), F("err", err))
+	}
+}
+
+// Current returns the cached token, which may be empty or expired.
+func (p *AccessTokenProvider) Current() AccessToken {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.token
+}
+
+// refreshBefore never exceeds half the lifetime of t, so short lived tokens
+// are not refreshed on every call.
+func (p *AccessTokenProvider) refreshBefore(t AccessToken) time.Duration {
+	d := p.RefreshBefore
+	if d == 0 {
+		d = DefaultTokenRefreshBefore
+	}
+	if t.CreatedAt > 0 && t.ExpiresAt > t.CreatedAt {
+		if half := time.Duration(t.ExpiresAt-t.CreatedAt) * time.Millisecond / 2; d > half {
+			d = half
+		}
+	}
+	return d
+}
+
+// refresh starts a refresh unless one is running, p.mu must be held. The
+// refresh outlives ctx so that one cancelled caller does not fail the others.
+func (p *AccessTokenProvider) refresh(ctx context.Context, rejected string) *tokenCall {
+	if p.call != nil {
+		return p.call
+	}
+	call := &tokenCall{done: make(chan struct{}), rejected: rejected}
+	p.call = call
+	go func() {
+		token, err := p.load(context.WithoutCancel(ctx), rejected)
+		if err == nil && len(token.Token) == 0 {
+			err = EmptyAccessTokenErr
+		}
+		p.mu.Lock()
+		if err == nil {
+			p.token = token
+		}
+		p.call = nil
+		p.mu.Unlock()
+		call.token, call.err = token, err
+		close(call.done)
+	}()
+	return call
+}
+
+// load takes the token from Store when it is fresh enough and not rejected,
+// otherwise it fetches one and publishes it with a compare-and-swap. When
+// another client won the swap its token is used instead.
+func (p *AccessTokenProvider) load(ctx context.Context, rejected string) (token AccessToken, err error) {
+	if p.Store == nil {
+		return p.Fetch(ctx)
+	}
+	now := time.Now()
+	stored, ok, err := p.Store.Get(ctx, p.Key)
+	if err != nil {
+		logTo(p.Logger, ctx, LogLevelWarn, "read token store failed", F("key", p.Key), F("err", err))
+		return p.Fetch(ctx)
+	}
+	if ok && stored.Token == rejected {
+		if len(rejected) > 0 {
+			logTo(p.Logger, ctx, LogLevelDebug, "stored token was rejected", F("key", p.Key))
+		}
+	} else if ok && stored.valid(now.Add(p.refreshBefore(stored))) {
+		token = stored
+		return
+	}
+	if token, err = p.Fetch(ctx); err != nil {
+		if ok && stored.Token != rejected && stored.valid(now) {
+			token, err = stored, nil
+		}
+		return
+	}
+	if !ok {
+		stored = AccessToken{}
+	}
+	swapped, e := p.Store.CompareAndSwap(ctx, p.Key, stored, token, tokenTTL(token))
+	if e != nil {
+		logTo(p.Logger, ctx, LogLevelWarn, "write token store failed", F("key", p.Key), F("err", e))
+		return
+	}
+	if !swapped {
+		if winner, ok, e := p.Store.Get(ctx, p.Key); e == nil && ok && winner.Token != rejected && winner.valid(now) {
+			token = winner
+		}
+	}
+	return
+}
+
+// newTokenProvider wraps fetch with the metrics and logging of o and shares
+// the token through o.TokenStore under key.
+func newTokenProvider(provider PlatformType, key string, o *ClientOptions, fetch TokenFetcher) *AccessTokenProvider {
+	p := NewAccessTokenProvider(func(ctx context.Context) (token AccessToken, err error) {
+		token, err = fetch(ctx)
+		o.metrics().TokenRefreshed(provider, err)
+		if err != nil {
+			logTo(o.logger(), ctx, LogLevelWarn, "refresh access token failed", F("provider", provider.String()), F("err", err))
+		}
+		return
+	})
+	p.Store = o.tokenStore()
+	p.Key = provider.String() + ":" + key
+	p.Logger = LoggerFunc(func(ctx context.Context, level LogLevel, msg string, fields ...Field) {
+		logTo(o.logger(), ctx, level, msg, append(fields, F("provider", provider.String()))...)
+	})
+	return p
+}
@@ -0,0 +1,42 @@
+package go_app_push
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Renew must not settle for the rejected token when a proactive refresh that
+// was running returns it again.
+func TestRenewAfterRunningRefresh(t *testing.T) {
+	entered, release := make(chan struct{}), make(chan struct{})
+	var fetches int32
+	p := NewAccessTokenProvider(func(ctx context.Context) (AccessToken, error) {
+		expires := time.Now().Add(time.Hour).UnixMilli()
+		if atomic.AddInt32(&fetches, 1) == 1 {
+			close(entered)
+			<-release
+			return AccessToken{Token: "rejected", ExpiresAt: expires}, nil
+		}
+		return AccessToken{Token: "fresh", ExpiresAt: expires}, nil
+	})
+	go p.Token(context.Background())
+	<-entered
+	renewed := make(chan string)
+	go func() {
+		token, err := p.Renew(context.Background(), "rejected")
+		if err != nil {
+			t.Error(err)
+		}
+		renewed <- token
+	}()
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	if token := <-renewed; token != "fresh" {
+		t.Errorf("Renew = %q, want fresh", token)
+	}
+	if n := atomic.LoadInt32(&fetches); n != 2 {
+		t.Errorf("fetches = %d, want 2", n)
+	}
+}
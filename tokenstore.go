@@ -0,0 +1,293 @@
+package go_app_push
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// TokenStore shares access tokens between clients and processes, so a fleet
+// of senders fetches one token per vendor app instead of one each. Keys look
+// like "oppo:<appKey>". Implementations must be safe for concurrent use.
+type TokenStore interface {
+	// Get returns ok false when key is missing or expired.
+	Get(ctx context.Context, key string) (token AccessToken, ok bool, err error)
+	// Set stores token under key for ttl.
+	Set(ctx context.Context, key string, token AccessToken, ttl time.Duration) error
+	// CompareAndSwap stores token only while key still holds old, compared on
+	// old.Token. An empty old.Token matches a missing key.
+	CompareAndSwap(ctx context.Context, key string, old, token AccessToken, ttl time.Duration) (swapped bool, err error)
+}
+
+func tokenTTL(token AccessToken) time.Duration {
+	return time.Until(time.UnixMilli(token.ExpiresAt))
+}
+
+// MemoryTokenStore shares tokens between the clients of one process.
+type MemoryTokenStore struct {
+	mu     sync.Mutex
+	tokens map[string]storedToken
+}
+
+type storedToken struct {
+	Token    AccessToken `json:"token"`
+	ExpireAt int64       `json:"expire_at"` // unix milliseconds
+}
+
+func (s storedToken) live(now time.Time) bool {
+	return s.ExpireAt > now.UnixMilli()
+}
+
+func newStoredToken(token AccessToken, ttl time.Duration) storedToken {
+	return storedToken{Token: token, ExpireAt: time.Now().Add(ttl).UnixMilli()}
+}
+
+func NewMemoryTokenStore() *MemoryTokenStore {
+	return &MemoryTokenStore{tokens: make(map[string]storedToken)}
+}
+
+func (s *MemoryTokenStore) Get(ctx context.Context, key string) (token AccessToken, ok bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, ok := s.tokens[key]
+	if ok && !st.live(time.Now()) {
+		delete(s.tokens, key)
+		ok = false
+	}
+	token = st.Token
+	return
+}
+
+func (s *MemoryTokenStore) Set(ctx context.Context, key string, token AccessToken, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens[key] = newStoredToken(token, ttl)
+	return nil
+}
+
+func (s *MemoryTokenStore) CompareAndSwap(ctx context.Context, key string, old, token AccessToken, ttl time.Duration) (swapped bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current, ok := s.tokens[key]
+	if !ok || !current.live(time.Now()) {
+		current = storedToken{}
+	}
+	if current.Token.Token != old.Token {
+		return
+	}
+	s.tokens[key] = newStoredToken(token, ttl)
+	swapped = true
+	return
+}
+
+// FileTokenStore keeps tokens in a JSON file shared by the processes of one
+// host. Writers take a lock file next to it, a lock older than staleLock is
+// assumed abandoned.
+type FileTokenStore struct {
+	path string
+	mu   sync.Mutex
+}
+
+const staleLock = 10 * time.Second
+
+func NewFileTokenStore(path string) *FileTokenStore {
+	return &FileTokenStore{path: path}
+}
+
+func (s *FileTokenStore) Get(ctx context.Context, key string) (token AccessToken, ok bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tokens, err := s.read()
+	if err != nil {
+		return
+	}
+	st, ok := tokens[key]
+	if ok && !st.live(time.Now()) {
+		ok = false
+	}
+	token = st.Token
+	return
+}
+
+func (s *FileTokenStore) Set(ctx context.Context, key string, token AccessToken, ttl time.Duration) error {
+	_, err := s.update(ctx, func(tokens map[string]storedToken) bool {
+		tokens[key] = newStoredToken(token, ttl)
+		return true
+	})
+	return err
+}
+
+func (s *FileTokenStore) CompareAndSwap(ctx context.Context, key string, old, token AccessToken, ttl time.Duration) (swapped bool, err error) {
+	return s.update(ctx, func(tokens map[string]storedToken) bool {
+		current, ok := tokens[key]
+		if !ok || !current.live(time.Now()) {
+			current = storedToken{}
+		}
+		if current.Token.Token != old.Token {
+			return false
+		}
+		tokens[key] = newStoredToken(token, ttl)
+		return true
+	})
+}
+
+// update applies fn under the file lock and writes the file when fn
+// returns true.
+func (s *FileTokenStore) update(ctx context.Context, fn func(map[string]storedToken) bool) (changed bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	unlock, err := s.lock(ctx)
+	if err != nil {
+		return
+	}
+	defer unlock()
+	tokens, err := s.read()
+	if err != nil {
+		return
+	}
+	if changed = fn(tokens); !changed {
+		return
+	}
+	now := time.Now()
+	for key, st := range tokens {
+		if !st.live(now) {
+			delete(tokens, key)
+		}
+	}
+	data, err := json.Marshal(tokens)
+	if err != nil {
+		return
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return
+	}
+	if err = tmp.Close(); err != nil {
+		return
+	}
+	err = os.Rename(tmp.Name(), s.path)
+	return
+}
+
+func (s *FileTokenStore) read() (tokens map[string]storedToken, err error) {
+	tokens = make(map[string]storedToken)
+	data, err := ioutil.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		err = nil
+		return
+	}
+	if err != nil || len(data) == 0 {
+		return
+	}
+	err = json.Unmarshal(data, &tokens)
+	return
+}
+
+func (s *FileTokenStore) lock(ctx context.Context) (unlock func(), err error) {
+	name := s.path + ".lock"
+	for {
+		var f *os.File
+		f, err = os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			f.Close()
+			unlock = func() { os.Remove(name) }
+			return
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return
+		}
+		if fi, e := os.Stat(name); e == nil && time.Since(fi.ModTime()) > staleLock {
+			os.Remove(name)
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+			return
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+}
+
+// KVClient is the contract for backing a TokenStore with a Redis-style
+// server. Values are AccessToken JSON. CompareAndSwap must be atomic on the
+// server, on Redis by running RedisCompareAndSwapScript with key as KEYS[1]
+// and old, value, the ttl and the current unix time, both in milliseconds,
+// as ARGV.
+type KVClient interface {
+	// Get returns ok false for a missing key.
+	Get(ctx context.Context, key string) (value string, ok bool, err error)
+	Set(ctx context.Context, key, value string, ttl time.Duration) error
+	// CompareAndSwap sets value while the "token" field of the value at key
+	// equals old. A missing value, or one whose "expires_at" has passed, has
+	// an empty token.
+	CompareAndSwap(ctx context.Context, key, old, value string, ttl time.Duration) (swapped bool, err error)
+}
+
+const RedisCompareAndSwapScript = `local v = redis.call("GET", KEYS[1])
+local current = ""
+if v then
+	local ok, t = pcall(cjson.decode, v)
+	if ok and type(t) == "table" and type(t.token) == "string" and tonumber(t.expires_at) and tonumber(t.expires_at) > tonumber(ARGV[4]) then
+		current = t.token
+	end
+end
+if current == ARGV[1] then
+	redis.call("SET", KEYS[1], ARGV[2], "PX", ARGV[3])
+	return 1
+end
+return 0`
+
+type kvTokenStore struct {
+	client KVClient
+	prefix string
+}
+
+// NewKVTokenStore stores tokens as JSON under prefix+key.
+func NewKVTokenStore(client KVClient, prefix string) TokenStore {
+	return &kvTokenStore{client: client, prefix: prefix}
+}
+
+func (s *kvTokenStore) Get(ctx context.Context, key string) (token AccessToken, ok bool, err error) {
+	value, ok, err := s.client.Get(ctx, s.prefix+key)
+	if err != nil || !ok {
+		return
+	}
+	err = json.Unmarshal([]byte(value), &token)
+	ok = err == nil && token.valid(time.Now())
+	return
+}
+
+func (s *kvTokenStore) Set(ctx context.Context, key string, token AccessToken, ttl time.Duration) error {
+	value, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+	return s.client.Set(ctx, s.prefix+key, string(value), kvTTL(ttl))
+}
+
+func (s *kvTokenStore) CompareAndSwap(ctx context.Context, key string, old, token AccessToken, ttl time.Duration) (swapped bool, err error) {
+	value, err := json.Marshal(token)
+	if err != nil {
+		return
+	}
+	return s.client.CompareAndSwap(ctx, s.prefix+key, old.Token, string(value), kvTTL(ttl))
+}
+
+// kvTTL keeps the ttl positive, Redis rejects SET with PX 0 or less.
+func kvTTL(ttl time.Duration) time.Duration {
+	if ttl < time.Millisecond {
+		return time.Millisecond
+	}
+	return ttl
+}
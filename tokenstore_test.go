@@ -0,0 +1,131 @@
+package go_app_push
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeKV follows RedisCompareAndSwapScript, and rejects a ttl Redis would.
+type fakeKV struct {
+	mu     sync.Mutex
+	values map[string]string
+	expiry map[string]time.Time
+}
+
+func newFakeKV() *fakeKV {
+	return &fakeKV{values: make(map[string]string), expiry: make(map[string]time.Time)}
+}
+
+func (kv *fakeKV) get(key string) (string, bool) {
+	if time.Now().After(kv.expiry[key]) {
+		delete(kv.values, key)
+	}
+	v, ok := kv.values[key]
+	return v, ok
+}
+
+func (kv *fakeKV) set(key, value string, ttl time.Duration) error {
+	if ttl < time.Millisecond {
+		return errors.New("ERR invalid expire time in 'set' command")
+	}
+	kv.values[key], kv.expiry[key] = value, time.Now().Add(ttl)
+	return nil
+}
+
+func (kv *fakeKV) Get(ctx context.Context, key string) (value string, ok bool, err error) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	value, ok = kv.get(key)
+	return
+}
+
+func (kv *fakeKV) Set(ctx context.Context, key, value string, ttl time.Duration) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	return kv.set(key, value, ttl)
+}
+
+func (kv *fakeKV) CompareAndSwap(ctx context.Context, key, old, value string, ttl time.Duration) (swapped bool, err error) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	current := ""
+	if v, ok := kv.get(key); ok {
+		var t AccessToken
+		if json.Unmarshal([]byte(v), &t) == nil && t.ExpiresAt > time.Now().UnixMilli() {
+			current = t.Token
+		}
+	}
+	if current != old {
+		return
+	}
+	err = kv.set(key, value, ttl)
+	swapped = err == nil
+	return
+}
+
+func testToken(token string, ttl time.Duration) AccessToken {
+	now := time.Now()
+	return AccessToken{Token: token, CreatedAt: now.UnixMilli(), ExpiresAt: now.Add(ttl).UnixMilli()}
+}
+
+func TestTokenStoreCompareAndSwap(t *testing.T) {
+	stores := map[string]TokenStore{
+		"memory": NewMemoryTokenStore(),
+		"file":   NewFileTokenStore(filepath.Join(t.TempDir(), "tokens.json")),
+		"kv":     NewKVTokenStore(newFakeKV(), "push:"),
+	}
+	ctx := context.Background()
+	for name, s := range stores {
+		a, b := testToken("a", time.Hour), testToken("b", time.Hour)
+		if ok, err := s.CompareAndSwap(ctx, "k", AccessToken{}, a, time.Hour); err != nil || !ok {
+			t.Fatalf("%s: swap into missing key: %v %v", name, ok, err)
+		}
+		if got, ok, err := s.Get(ctx, "k"); err != nil || !ok || got.Token != "a" {
+			t.Errorf("%s: Get = %v %v %v", name, got, ok, err)
+		}
+		if ok, _ := s.CompareAndSwap(ctx, "k", AccessToken{}, b, time.Hour); ok {
+			t.Errorf("%s: swapped over a live token with an empty old", name)
+		}
+		if ok, _ := s.CompareAndSwap(ctx, "k", testToken("x", time.Hour), b, time.Hour); ok {
+			t.Errorf("%s: swapped with the wrong old token", name)
+		}
+		// only old.Token is compared
+		if ok, err := s.CompareAndSwap(ctx, "k", AccessToken{Token: "a"}, b, time.Hour); err != nil || !ok {
+			t.Errorf("%s: swap on old.Token: %v %v", name, ok, err)
+		}
+		// an expired token counts as missing
+		expiring := testToken("c", 10*time.Millisecond)
+		if err := s.Set(ctx, "e", expiring, 10*time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+		if _, ok, _ := s.Get(ctx, "e"); ok {
+			t.Errorf("%s: Get returned an expired token", name)
+		}
+		if ok, err := s.CompareAndSwap(ctx, "e", AccessToken{}, a, -time.Second); err != nil || !ok {
+			t.Errorf("%s: swap over an expired token with ttl <= 0: %v %v", name, ok, err)
+		}
+	}
+}
+
+// The KV key may outlive the token in it, Get and CompareAndSwap must agree
+// that it is gone.
+func TestKVTokenStoreExpiredValue(t *testing.T) {
+	kv := newFakeKV()
+	s := NewKVTokenStore(kv, "")
+	ctx := context.Background()
+	if err := s.Set(ctx, "k", testToken("old", -time.Minute), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := s.Get(ctx, "k"); ok {
+		t.Fatal("Get returned an expired token")
+	}
+	if ok, err := s.CompareAndSwap(ctx, "k", AccessToken{}, testToken("new", time.Hour), time.Hour); err != nil || !ok {
+		t.Errorf("swap = %v %v, want swapped", ok, err)
+	}
+}
@@ -0,0 +1,53 @@
+package go_app_push
+
+import (
+	"context"
+	"errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/withgame/go-app-push"
+
+// pushSpan is a span that may be nil when no TracerProvider is configured.
+type pushSpan struct {
+	span trace.Span
+}
+
+func startSpan(ctx context.Context, tp trace.TracerProvider, name string, kind trace.SpanKind, attrs ...attribute.KeyValue) (context.Context, *pushSpan) {
+	if tp == nil {
+		return ctx, nil
+	}
+	ctx, span := tp.Tracer(tracerName).Start(ctx, name, trace.WithSpanKind(kind), trace.WithAttributes(attrs...))
+	return ctx, &pushSpan{span: span}
+}
+
+func (s *pushSpan) set(attrs ...attribute.KeyValue) {
+	if s == nil {
+		return
+	}
+	s.span.SetAttributes(attrs...)
+}
+
+func (s *pushSpan) end(err error) {
+	if s == nil {
+		return
+	}
+	s.fail(err)
+	s.span.End()
+}
+
+// fail records err on the span without ending it.
+func (s *pushSpan) fail(err error) {
+	if s == nil {
+		return
+	}
+	if err != nil {
+		if msg := Redact(err.Error()); msg != err.Error() {
+			err = errors.New(msg)
+		}
+		s.span.RecordError(err)
+		s.span.SetStatus(codes.Error, err.Error())
+	}
+}
@@ -0,0 +1,84 @@
+package go_app_push
+
+import (
+	"context"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+	"sync"
+	"testing"
+)
+
+type recordedSpan struct {
+	noop.Span
+	name  string
+	attrs map[attribute.Key]attribute.Value
+	ended bool
+}
+
+func (s *recordedSpan) SetAttributes(kv ...attribute.KeyValue) {
+	for _, a := range kv {
+		s.attrs[a.Key] = a.Value
+	}
+}
+
+func (s *recordedSpan) End(...trace.SpanEndOption) {
+	s.ended = true
+}
+
+type recordingProvider struct {
+	noop.TracerProvider
+	tracer *recordingTracer
+}
+
+func (p recordingProvider) Tracer(string, ...trace.TracerOption) trace.Tracer {
+	return p.tracer
+}
+
+// recordingTracer keeps every span it starts.
+type recordingTracer struct {
+	noop.Tracer
+	mu    sync.Mutex
+	spans []*recordedSpan
+}
+
+func (t *recordingTracer) Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	s := &recordedSpan{name: name, attrs: make(map[attribute.Key]attribute.Value)}
+	cfg := trace.NewSpanStartConfig(opts...)
+	s.SetAttributes(cfg.Attributes()...)
+	t.mu.Lock()
+	t.spans = append(t.spans, s)
+	t.mu.Unlock()
+	return trace.ContextWithSpan(ctx, s), s
+}
+
+// The client span of a vendor call carries the ids parsed from its response.
+func TestClientSpanHasBatchIds(t *testing.T) {
+	srv := newVendorServer()
+	defer srv.Close()
+	tracer := &recordingTracer{}
+	cfg := vendorConfigs(srv.URL)[0]
+	cfg.Tracer = recordingProvider{tracer: tracer}
+	client, err := NewAppPushWithConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.Push("t", "b", nil, []string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	var call *recordedSpan
+	for _, s := range tracer.spans {
+		if !s.ended {
+			t.Errorf("span %q not ended", s.name)
+		}
+		if s.name == "xiaomi "+PRO_API_XM_ALIAS {
+			call = s
+		}
+	}
+	if call == nil {
+		t.Fatalf("no client span in %d spans", len(tracer.spans))
+	}
+	if id := call.attrs["push.message_id"].AsString(); id != "x1" {
+		t.Errorf("push.message_id = %q, want x1", id)
+	}
+}
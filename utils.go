@@ -2,11 +2,15 @@ package go_app_push
 
 import (
 	"bytes"
-	"crypto/tls"
+	"context"
 	"errors"
 	"fmt"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
 )
@@ -18,19 +22,169 @@ type PushReq struct {
 	Method   string
 	Url      string
 	Body     []byte
-	Timeout  int
+	Timeout  int // seconds, overrides the client timeout when shorter
 	User     string
 	Password string
 	Headers  map[string]string
 	Request  *http.Request
 	Client   *http.Client
+	Logger   Logger
+	Provider PlatformType
+	Endpoint string
+	Retry    RetryPolicy
+	Limiter  *RateLimiter
+	Breaker  *CircuitBreaker
+	Metrics  Metrics
+	Tracer   trace.TracerProvider
+	Tokens   int // tokens carried by the request, for tracing
+	Kind     EndpointKind
+	Check    func(body []byte) error // reports a failed vendor code of a 200 response as a *PushError
+	// Expired reports a response meaning the access token was revoked or timed
+	// out, Reauth then renews the token in the request before it is replayed.
+	Expired func(header http.Header, err error) bool
+	Reauth  func(ctx context.Context) error
+	// Idempotent marks a push the vendor deduplicates, e.g. by VIVO's
+	// requestId, so it is replayed even when it may have been delivered.
+	Idempotent bool
+	Attempts   int
+	keepSpan   bool // leave the span of the last attempt open in span
+	span       *pushSpan
 }
 
 func newPushReq() *PushReq {
 	return new(PushReq)
 }
 
-func (r *PushReq) doPushRequest() (body []byte, statusCode int, header http.Header, err error) {
+// endpointURL joins the path of endpoint to base, or to defaultBase when base
+// is empty. endpoint is either a path or a full URL on the default host.
+func endpointURL(base, defaultBase, endpoint string) string {
+	if len(base) == 0 {
+		base = defaultBase
+	}
+	if u, err := url.Parse(endpoint); err == nil && u.IsAbs() {
+		endpoint = u.RequestURI()
+	}
+	return strings.TrimSuffix(base, "/") + endpoint
+}
+
+// checkBaseURL accepts an empty base or an absolute http(s) URL.
+func checkBaseURL(base string) (err error) {
+	if len(base) == 0 {
+		return
+	}
+	u, e := url.Parse(base)
+	if e != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+		err = fmt.Errorf("%w: %q", InvalidBaseURLErr, base)
+	}
+	return
+}
+
+// doPushRequest sends the request, repeating it according to r.Retry. Vendor
+// and HTTP failures are returned as *PushError.
+func (r *PushReq) doPushRequest(ctx context.Context) (body []byte, statusCode int, header http.Header, err error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	metrics := metricsOrNop(r.Metrics)
+	reauths := 0
+	var span *pushSpan
+	defer func() {
+		if r.keepSpan {
+			r.span = span
+		} else {
+			span.end(nil)
+		}
+	}()
+	for r.Attempts = 1; ; r.Attempts++ {
+		if err = r.Limiter.Wait(ctx, r.Kind); err != nil {
+			if errors.Is(err, LocalRateLimitErr) {
+				err = &PushError{Provider: r.Provider, Endpoint: r.Endpoint, Category: ErrorCategoryRateLimited, Err: err}
+			}
+			return
+		}
+		key := r.Breaker.key(r)
+		if err = r.Breaker.allow(key); err != nil {
+			err = &PushError{Provider: r.Provider, Endpoint: r.Endpoint, Category: ErrorCategoryTransient, Err: err}
+			return
+		}
+		metrics.RequestStarted(r.Provider, r.Endpoint)
+		var spanCtx context.Context
+		span.end(nil) // of the previous attempt
+		spanCtx, span = startSpan(ctx, r.Tracer, r.Provider.String()+" "+r.Endpoint, trace.SpanKindClient,
+			attribute.String("push.vendor", r.Provider.String()),
+			attribute.String("push.endpoint", r.Endpoint),
+			attribute.Int("push.chunk_size", r.Tokens),
+			attribute.Int("push.attempt", r.Attempts))
+		start := time.Now()
+		body, statusCode, header, err = r.roundTrip(spanCtx)
+		err = r.classify(ctx, statusCode, header, body, err)
+		metrics.RequestFinished(r.Provider, r.Endpoint, statusCode, vendorCode(err), time.Since(start), err)
+		span.set(attribute.Int("http.status_code", statusCode), attribute.String("push.vendor_code", vendorCode(err)))
+		span.fail(err)
+		r.Breaker.done(ctx, key, err)
+		if reauths == 0 && r.Reauth != nil && r.Expired != nil && r.Expired(header, err) {
+			reauths++
+			logTo(r.Logger, ctx, LogLevelInfo, "access token rejected, re-authenticating", F("provider", r.Provider.String()), F("err", err))
+			if e := r.Reauth(ctx); e != nil {
+				err = e
+				return
+			}
+			continue
+		}
+		if !r.replayable(err) || !r.Retry.wait(ctx, r.Attempts-reauths, err) {
+			return
+		}
+		metrics.Retried(r.Provider, r.Endpoint)
+		logTo(r.Logger, ctx, LogLevelDebug, "retry push request", F("url", r.Url), F("attempt", r.Attempts+1), F("err", err))
+	}
+}
+
+// replayable reports whether repeating the request after err cannot push a
+// message twice. Token requests and GETs are always safe, other requests only
+// when they are idempotent or err proves they never reached the vendor.
+func (r *PushReq) replayable(err error) bool {
+	return r.Idempotent || r.Kind == EndpointAuth || strings.ToUpper(r.Method) == "GET" || !maybeDelivered(err)
+}
+
+// send runs the request for batch and records the outcome on it. The span of
+// the last attempt is ended by batch.done, once the ids are parsed.
+func (r *PushReq) send(ctx context.Context, batch *BatchResult) (body []byte, err error) {
+	r.Tokens = len(batch.Tokens)
+	r.keepSpan = true
+	body, batch.StatusCode, _, err = r.doPushRequest(ctx)
+	batch.span, r.span = r.span, nil
+	batch.Attempts = r.Attempts
+	if code := vendorCode(err); len(code) > 0 {
+		batch.Code = code
+	}
+	return
+}
+
+func (r *PushReq) classify(ctx context.Context, statusCode int, header http.Header, body []byte, err error) error {
+	if err == nil && r.Check != nil {
+		err = r.Check(body)
+	}
+	var pe *PushError
+	if !errors.As(err, &pe) {
+		err = wrapRequestErr(ctx, r.Provider, r.Endpoint, statusCode, err)
+		if !errors.As(err, &pe) {
+			return err
+		}
+	}
+	if len(pe.Endpoint) == 0 {
+		pe.Endpoint = r.Endpoint
+	}
+	if pe.StatusCode == 0 {
+		pe.StatusCode = statusCode
+	}
+	if errors.Is(err, HttpServerErr) {
+		pe.setResponse(header, body)
+	}
+	pe.RetryAfter = parseRetryAfter(header)
+	return err
+}
+
+func (r *PushReq) roundTrip(ctx context.Context) (body []byte, statusCode int, header http.Header, err error) {
 	if r.Method == "" {
 		r.Method = "POST"
 	}
@@ -38,12 +192,19 @@ func (r *PushReq) doPushRequest() (body []byte, statusCode int, header http.Head
 		err = MissingUrlErr
 		return
 	}
-	//bodyStr, _ := url.QueryUnescape(string(r.Body))
-	fmt.Printf("url.QueryUnescapeBody:%s\n\n", string(r.Body))
+	logTo(r.Logger, ctx, LogLevelDebug, "push request", F("method", r.Method), F("url", r.Url), F("body", string(r.Body)))
+	if r.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(r.Timeout)*time.Second)
+		defer cancel()
+	}
 	if strings.ToUpper(r.Method) == "POST" {
-		r.Request, err = http.NewRequest(r.Method, r.Url, bytes.NewBuffer(r.Body))
+		r.Request, err = http.NewRequestWithContext(ctx, r.Method, r.Url, bytes.NewBuffer(r.Body))
 	} else if strings.ToUpper(r.Method) == "GET" {
-		r.Request, err = http.NewRequest(r.Method, r.Url, nil)
+		r.Request, err = http.NewRequestWithContext(ctx, r.Method, r.Url, nil)
+	}
+	if err != nil {
+		return
 	}
 	if _, ok := r.Headers["Content-Type"]; !ok {
 		r.Request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
@@ -53,32 +214,37 @@ func (r *PushReq) doPushRequest() (body []byte, statusCode int, header http.Head
 			r.Request.Header.Set(k, v)
 		}
 	}
-	if r.Timeout == 0 {
-		r.Timeout = 30
-	}
-	tr := &http.Transport{
-		MaxIdleConns:       10,
-		IdleConnTimeout:    time.Duration(r.Timeout) * time.Second,
-		DisableCompression: true,
-		TLSClientConfig:    &tls.Config{InsecureSkipVerify: true},
+	if r.Client == nil {
+		r.Client = sharedHTTPClient()
 	}
-	r.Client = &http.Client{Transport: tr}
-
 	resp, err := r.Client.Do(r.Request)
-	fmt.Printf("r.Client.resp:%v\n", resp)
-	fmt.Printf("r.Client.DoErr:%v\n", err)
 	if err != nil {
+		logTo(r.Logger, ctx, LogLevelDebug, "push request failed", F("url", r.Url), F("err", err))
 		return
 	}
-	fmt.Printf("r.Client.resp.StatusCode:%v\n\n", resp.StatusCode)
+	statusCode = resp.StatusCode
+	header = resp.Header
 	if resp.StatusCode != 200 {
+		body, _ = ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBody+1))
+		io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64<<10))
+		resp.Body.Close()
+		logTo(r.Logger, ctx, LogLevelDebug, "push response", F("url", r.Url), F("status", statusCode), F("body", string(body)))
 		err = HttpServerErr
 		return
 	}
-	statusCode = resp.StatusCode
-	header = resp.Header
 	defer resp.Body.Close()
 	body, err = ioutil.ReadAll(resp.Body)
-	fmt.Printf("utils----r.Client.resp.Body:%s\n\n", string(body))
+	logTo(r.Logger, ctx, LogLevelDebug, "push response", F("url", r.Url), F("status", statusCode), F("body", string(body)))
+	return
+}
+
+func splitTokens(tokens []string, size int) (chunks [][]string) {
+	for len(tokens) > size {
+		chunks = append(chunks, tokens[:size])
+		tokens = tokens[size:]
+	}
+	if len(tokens) > 0 {
+		chunks = append(chunks, tokens)
+	}
 	return
 }
@@ -0,0 +1,124 @@
+package go_app_push
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// maxClockSkew is the difference to the vendor clock worth a hint, OPPO and
+// VIVO sign their auth requests with a timestamp.
+const maxClockSkew = time.Minute
+
+// VerifyReport is the outcome of Verify. It is filled as far as the vendor
+// call got, Err tells why the credentials could not be confirmed.
+type VerifyReport struct {
+	Provider         PlatformType
+	Endpoint         string // endpoint called to verify
+	CredentialsValid bool
+	PackageChecked   bool          // the vendor call checked the package name
+	PackageValid     bool          // meaningful only when PackageChecked
+	TokenLifetime    time.Duration // time left on the access token, 0 for vendors without one
+	ClockSkew        time.Duration // vendor clock minus local clock, from OPPO's create_time or the Date header
+	Hints            []string
+	Err              error
+}
+
+func newVerifyReport(provider PlatformType, endpoint string) *VerifyReport {
+	return &VerifyReport{Provider: provider, Endpoint: endpoint}
+}
+
+// clock records the skew between a vendor timestamp and the local time it
+// was taken at.
+func (r *VerifyReport) clock(vendor, local time.Time) {
+	r.ClockSkew = vendor.Sub(local).Round(time.Second)
+	if r.ClockSkew > maxClockSkew || r.ClockSkew < -maxClockSkew {
+		r.hint("local clock differs from the %s clock by %s, signed requests may be rejected", r.Provider, r.ClockSkew)
+	}
+}
+
+func (r *VerifyReport) hint(format string, args ...interface{}) {
+	r.Hints = append(r.Hints, fmt.Sprintf(format, args...))
+}
+
+// observe records the outcome of the verification call made at start and
+// returns r.Err. When the call checks the package name, a rejected payload
+// means the credentials were accepted.
+func (r *VerifyReport) observe(start time.Time, header http.Header, token AccessToken, err error) error {
+	if date, e := http.ParseTime(header.Get("Date")); e == nil && r.ClockSkew == 0 {
+		r.clock(date, start)
+	}
+	if token.ExpiresAt > 0 {
+		r.TokenLifetime = time.UnixMilli(token.ExpiresAt).Sub(start).Round(time.Second)
+		if r.TokenLifetime < 2*DefaultTokenRefreshBefore {
+			r.hint("access token lives only %s", r.TokenLifetime)
+		}
+	}
+	r.Err = err
+	switch {
+	case err == nil:
+		r.CredentialsValid = true
+		r.PackageValid = r.PackageChecked
+	case r.PackageChecked && errors.Is(err, ErrorCategoryPayloadInvalid):
+		r.CredentialsValid = true
+		r.hint("%s accepted the credentials but rejected the request, check the package name", r.Provider)
+	case errors.Is(err, ErrorCategoryAuthFailed):
+		r.hint("%s rejected the credentials", r.Provider)
+	default:
+		r.hint("verification did not complete, the credentials are unconfirmed")
+	}
+	return r.Err
+}
+
+// token gets the access token checked by Verify through p. Unless force is
+// set, a valid token in the cache or in the TokenStore is reported without
+// asking the vendor, so Verify does not spend the daily token allowance. A
+// fetched token is cached and stored for the next push.
+func (r *VerifyReport) token(ctx context.Context, p *AccessTokenProvider, force bool,
+	fetch func(ctx context.Context) (AccessToken, http.Header, error)) (token AccessToken, header http.Header, err error) {
+	if !force {
+		var ok bool
+		if token, ok = p.cached(ctx); ok {
+			r.hint("a cached access token is valid, %s was not asked again", r.Provider)
+			return
+		}
+	}
+	if token, header, err = fetch(ctx); err == nil {
+		p.publish(ctx, token)
+	}
+	return
+}
+
+// Verify checks the credentials of the active vendor client without sending
+// a message. Huawei, OPPO and VIVO are not asked while a cached or stored
+// access token is valid.
+func (c *AppPush) Verify(ctx context.Context) (report *VerifyReport, err error) {
+	return c.verify(ctx, false)
+}
+
+// VerifyFresh is Verify, but always asks the vendor for a new access token.
+func (c *AppPush) VerifyFresh(ctx context.Context) (report *VerifyReport, err error) {
+	return c.verify(ctx, true)
+}
+
+func (c *AppPush) verify(ctx context.Context, force bool) (report *VerifyReport, err error) {
+	c = c.snapshot()
+	switch c.Provider {
+	case PlatformHUAWEI:
+		report, err = c.HWPush.verify(ctx, force)
+	case PlatformOPPO:
+		report, err = c.OPPush.verify(ctx, force)
+	case PlatformVIVO:
+		report, err = c.VOPush.verify(ctx, force)
+	case PlatformMEIZU:
+		report, err = c.MZPush.Verify(ctx)
+	default:
+		report, err = c.XMPush.Verify(ctx)
+	}
+	if err != nil {
+		logTo(c.Logger, ctx, LogLevelWarn, "verify failed", F("provider", c.Provider.String()), F("err", err))
+	}
+	return
+}
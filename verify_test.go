@@ -0,0 +1,91 @@
+package go_app_push
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newCountingServer wraps newVendorServer and counts the requests to path.
+func newCountingServer(t *testing.T, path string, n *int32) *httptest.Server {
+	vendor := newVendorServer()
+	t.Cleanup(vendor.Close)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == path {
+			atomic.AddInt32(n, 1)
+		}
+		vendor.Config.Handler.ServeHTTP(w, r)
+	}))
+	return srv
+}
+
+// Verify spends no auth token while one is cached or stored, and leaves the
+// token it fetched for the next push and for the other clients.
+func TestVerifyReusesToken(t *testing.T) {
+	var fetches int32
+	srv := newCountingServer(t, "/auth", &fetches)
+	defer srv.Close()
+	store := NewMemoryTokenStore()
+	cfg := vendorConfigs(srv.URL)[2]
+	cfg.TokenStore = store
+	client, err := NewAppPushWithConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if report, err := client.Verify(ctx); err != nil || !report.CredentialsValid {
+			t.Fatalf("report %+v, err %v", report, err)
+		}
+	}
+	if _, err = client.PushMessage(ctx, &Message{Title: "t", Body: "b"}, []string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&fetches); n != 1 {
+		t.Errorf("fetches = %d, want 1", n)
+	}
+
+	other, err := NewAppPushWithConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = other.Verify(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&fetches); n != 1 {
+		t.Errorf("fetches = %d after Verify with a stored token, want 1", n)
+	}
+	if _, err = other.VerifyFresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&fetches); n != 2 {
+		t.Errorf("fetches = %d after VerifyFresh, want 2", n)
+	}
+}
+
+// OPPO returns no token lifetime, but its create_time shows the clock skew.
+func TestVerifyOPPOClock(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		created := time.Now().Add(-5 * time.Minute).UnixMilli()
+		fmt.Fprintf(w, `{"code":0,"data":{"auth_token":"optok","create_time":%d}}`, created)
+	}))
+	defer srv.Close()
+	client, err := NewAppPushWithConfig(vendorConfigs(srv.URL)[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := client.Verify(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.TokenLifetime != 0 {
+		t.Errorf("TokenLifetime = %s, want 0", report.TokenLifetime)
+	}
+	if report.ClockSkew > -4*time.Minute || report.ClockSkew < -6*time.Minute {
+		t.Errorf("ClockSkew = %s, want about -5m", report.ClockSkew)
+	}
+}
@@ -1,14 +1,17 @@
 package go_app_push
 
 import (
+	"context"
 	"crypto/md5"
 	"encoding/base64"
 	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
-	"errors"
 	"fmt"
-	"github.com/golang/glog"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -21,9 +24,11 @@ const (
 	PRO_API_VIVO_SUBFIX_UNICASTBATCH string = "/message/pushToList"
 )
 
+const vivoTokenTTL int64 = 24 * 3600 * 1000
+
 type (
-	VIVOPushType uint32
-	VIVONotifyType uint32
+	VIVOPushType       uint32
+	VIVONotifyType     uint32
 	VIVONotifyOpenType uint32
 )
 
@@ -48,25 +53,46 @@ const (
 )
 
 var pid = uint32(time.Now().UnixNano() % 4294967291)
+var requestSeq uint32
 
 type VIVOPush struct {
-	AuthToken        string            `url:"-" json:"-"`
-	TokenCreatedAt   int64             `url:"-" json:"-"`
-	AppSecretKey     string            `url:"-" json:"-"`
-	IgnoreCheckToken bool              `url:"-" json:"-"`
-	Sign             string            `url:"sign,omitempty" json:"sign,omitempty"`
-	AppId            int               `url:"appId,omitempty" json:"appId,omitempty"`
-	AppKey           string            `url:"appKey,omitempty" json:"appKey,omitempty"`
-	Timestamp        int64             `url:"timestamp,omitempty" json:"timestamp,omitempty"`
-	Notify           VIVONotifyPayload `url:"-" json:"-"`
+	AppId        int
+	AppKey       string
+	AppSecretKey string
+	BaseURL      string // replaces PRO_API_VIVO_PREFIX when set
+	ClientOptions
+	tokenOnce sync.Once
+	tokens    *AccessTokenProvider
+}
+
+type VIVOAuthPayload struct {
+	Sign      string `json:"sign,omitempty"`
+	AppId     int    `json:"appId,omitempty"`
+	AppKey    string `json:"appKey,omitempty"`
+	Timestamp int64  `json:"timestamp,omitempty"`
+}
+
+// voErrCategories maps VIVO result codes to error categories.
+var voErrCategories = map[string]ErrorCategory{
+	"10000": ErrorCategoryAuthFailed,     //权限认证失败
+	"10050": ErrorCategoryPayloadInvalid, //alias和regId不能都为空
+	"10070": ErrorCategoryQuotaExceeded,  //发送消息数量超过限制
+	"10302": ErrorCategoryInvalidToken,   //regId不合法
 }
 
 type VIVOCommonResponse struct {
-	Code       int                 `json:"result,omitempty"`
-	Message    string              `json:"desc,omitempty"`
-	AuthToken  string              `json:"authToken,omitempty"`
-	TaskId     string              `json:"taskId,omitempty"`
-	Statistics []map[string]string `json:"statistics,omitempty"`
+	Code         int                 `json:"result,omitempty"`
+	Message      string              `json:"desc,omitempty"`
+	AuthToken    string              `json:"authToken,omitempty"`
+	TaskId       string              `json:"taskId,omitempty"`
+	RequestId    string              `json:"requestId,omitempty"`
+	Statistics   []map[string]string `json:"statistics,omitempty"`
+	InvalidUsers []VIVOInvalidUser   `json:"invalidUsers,omitempty"`
+}
+
+type VIVOInvalidUser struct {
+	Status int    `json:"status"`
+	UserId string `json:"userid"`
 }
 
 type VIVONotifyPayload struct {
@@ -94,73 +120,53 @@ func newVIVOPush() *VIVOPush {
 	return new(VIVOPush)
 }
 
-func (vo *VIVOPush) checkTokenExpired() {
-	if vo.TokenCreatedAt+86400000 < vo.ms() {
-		vo.IgnoreCheckToken = true
-		err := vo.getToken()
-		glog.Info("checkTokenExpired----vo.getTokenErr:%v\n", err)
-	}
+// Verify requests an auth token. VIVO matches the app id with the app key and
+// checks the app secret through the signature. VIVO limits the auth tokens
+// issued per day, so a valid cached token is reported instead.
+func (vo *VIVOPush) Verify(ctx context.Context) (report *VerifyReport, err error) {
+	return vo.verify(ctx, false)
 }
 
-func (vo *VIVOPush) getToken() (err error) {
-	vo.sign()
-	req, err := vo.buildReq(PRO_API_VIVO_SUBFIX_TOKEN)
-	if err != nil {
-		return
-	}
-	v, _ := json.Marshal(vo)
-	req.Body = v
-	body, _, _, err := req.doPushRequest()
-	if err != nil {
-		return
-	}
-	resp := VIVOCommonResponse{}
-	err = json.Unmarshal(body, &resp)
-	if err != nil {
-		return
-	}
-	if resp.Code > 0 {
-		err = errors.New(resp.Message)
-		return
-	}
-	vo.AuthToken = resp.AuthToken
-	vo.TokenCreatedAt = vo.ms()
-	vo.IgnoreCheckToken = false
+// VerifyFresh is Verify, but always requests a new auth token.
+func (vo *VIVOPush) VerifyFresh(ctx context.Context) (report *VerifyReport, err error) {
+	return vo.verify(ctx, true)
+}
+
+func (vo *VIVOPush) verify(ctx context.Context, force bool) (report *VerifyReport, err error) {
+	report = newVerifyReport(PlatformVIVO, PRO_API_VIVO_SUBFIX_TOKEN)
+	start := time.Now()
+	_, header, err := report.token(ctx, vo.tokenProvider(), force, vo.fetchToken)
+	// the token lifetime is computed locally, VIVO does not return it
+	err = report.observe(start, header, AccessToken{}, err)
+	report.hint("auth token lifetime of 24h is documented, not returned by %s", PlatformVIVO)
+	report.hint("package name is not checked by the auth endpoint")
 	return
 }
 
-func (vo *VIVOPush) SaveNotifyToVIVO() (taskId string, err error) {
-	req, err := vo.buildReq(PRO_API_VIVO_SUBFIX_SAVE)
-	if err != nil {
-		return
-	}
-	v, _ := json.Marshal(vo.Notify)
-	req.Body = v
-	body, _, _, err := req.doPushRequest()
-	if err != nil {
-		return
-	}
-	resp := VIVOCommonResponse{}
-	err = json.Unmarshal(body, &resp)
-	if err != nil {
-		return
-	}
-	if resp.Code > 0 {
-		err = errors.New(resp.Message)
-		return
-	}
-	taskId = resp.TaskId
+func (vo *VIVOPush) tokenProvider() *AccessTokenProvider {
+	vo.tokenOnce.Do(func() {
+		vo.tokens = newTokenProvider(PlatformVIVO, strconv.Itoa(vo.AppId), &vo.ClientOptions, vo.getToken)
+	})
+	return vo.tokens
+}
+
+func (vo *VIVOPush) checkTokenExpired(ctx context.Context) (authToken string, err error) {
+	return vo.tokenProvider().Token(ctx)
+}
+
+func (vo *VIVOPush) getToken(ctx context.Context) (accessToken AccessToken, err error) {
+	accessToken, _, err = vo.fetchToken(ctx)
 	return
 }
 
-func (vo *VIVOPush) PushBroadCast() (taskId string, err error) {
-	req, err := vo.buildReq(PRO_API_VIVO_SUBFIX_BROADCAST)
+func (vo *VIVOPush) fetchToken(ctx context.Context) (accessToken AccessToken, header http.Header, err error) {
+	req, err := vo.newReq(PRO_API_VIVO_SUBFIX_TOKEN)
 	if err != nil {
 		return
 	}
-	v, _ := json.Marshal(vo.Notify)
+	v, _ := json.Marshal(vo.sign())
 	req.Body = v
-	body, _, _, err := req.doPushRequest()
+	body, _, header, err := req.doPushRequest(ctx)
 	if err != nil {
 		return
 	}
@@ -169,70 +175,117 @@ func (vo *VIVOPush) PushBroadCast() (taskId string, err error) {
 	if err != nil {
 		return
 	}
-	if resp.Code > 0 {
-		err = errors.New(resp.Message)
-		return
-	}
-	taskId = resp.TaskId
+	//authToken有效期1天
+	accessToken.Token = resp.AuthToken
+	accessToken.CreatedAt = vo.ms()
+	accessToken.ExpiresAt = accessToken.CreatedAt + vivoTokenTTL
 	return
 }
 
-func (vo *VIVOPush) PushUniCast() (taskId string, err error) {
-	if len(vo.Notify.Alias) == 0 || len(vo.Notify.RegId) == 0 {
+func (vo *VIVOPush) SaveNotifyToVIVO(notify VIVONotifyPayload) (taskId string, err error) {
+	return vo.SaveNotifyToVIVOWithContext(context.Background(), notify)
+}
+
+func (vo *VIVOPush) SaveNotifyToVIVOWithContext(ctx context.Context, notify VIVONotifyPayload) (taskId string, err error) {
+	batch := &BatchResult{Endpoint: PRO_API_VIVO_SUBFIX_SAVE}
+	err = vo.saveBatchNotify(ctx, notify, batch)
+	taskId = batch.TaskId
+	return
+}
+
+func (vo *VIVOPush) PushBroadCast(notify VIVONotifyPayload) (taskId string, err error) {
+	return vo.PushBroadCastWithContext(context.Background(), notify)
+}
+
+func (vo *VIVOPush) PushBroadCastWithContext(ctx context.Context, notify VIVONotifyPayload) (taskId string, err error) {
+	batch := &BatchResult{Endpoint: PRO_API_VIVO_SUBFIX_BROADCAST}
+	err = vo.send(ctx, notify, batch)
+	taskId = batch.TaskId
+	return
+}
+
+func (vo *VIVOPush) PushUniCast(notify VIVONotifyPayload) (taskId string, err error) {
+	return vo.PushUniCastWithContext(context.Background(), notify)
+}
+
+func (vo *VIVOPush) PushUniCastWithContext(ctx context.Context, notify VIVONotifyPayload) (taskId string, err error) {
+	batch := &BatchResult{Endpoint: PRO_API_VIVO_SUBFIX_UNICAST}
+	err = vo.pushUniCast(ctx, notify, batch)
+	taskId = batch.TaskId
+	return
+}
+
+func (vo *VIVOPush) pushUniCast(ctx context.Context, notify VIVONotifyPayload, batch *BatchResult) (err error) {
+	if len(notify.Alias) == 0 && len(notify.RegId) == 0 {
 		err = VIVOMissingTargetErr
+		batch.Err = err
 		return
 	}
-	req, err := vo.buildReq(PRO_API_VIVO_SUBFIX_UNICAST)
-	if err != nil {
-		return
+	if len(notify.Alias) > 0 {
+		batch.Tokens = []string{notify.Alias}
+	} else {
+		batch.Tokens = []string{notify.RegId}
 	}
-	v, _ := json.Marshal(vo.Notify)
-	req.Body = v
-	body, _, _, err := req.doPushRequest()
-	if err != nil {
-		return
+	return vo.send(ctx, notify, batch)
+}
+
+// PushUniBatchCast saves the notification first unless notify.TaskId already
+// refers to saved content.
+func (vo *VIVOPush) PushUniBatchCast(notify VIVONotifyPayload) (err error) {
+	return vo.PushUniBatchCastWithContext(context.Background(), notify)
+}
+
+func (vo *VIVOPush) PushUniBatchCastWithContext(ctx context.Context, notify VIVONotifyPayload) (err error) {
+	if len(notify.TaskId) == 0 {
+		save := &BatchResult{Endpoint: PRO_API_VIVO_SUBFIX_SAVE}
+		if err = vo.saveBatchNotify(ctx, notify, save); err != nil {
+			return
+		}
+		notify.TaskId = save.TaskId
 	}
-	resp := VIVOCommonResponse{}
-	err = json.Unmarshal(body, &resp)
-	if err != nil {
+	batch := &BatchResult{Endpoint: PRO_API_VIVO_SUBFIX_UNICASTBATCH}
+	return vo.pushUniBatchCast(ctx, notify, batch)
+}
+
+func (vo *VIVOPush) saveBatchNotify(ctx context.Context, notify VIVONotifyPayload, batch *BatchResult) (err error) {
+	notify.Alias = ""
+	notify.RegId = ""
+	notify.Aliases = nil
+	notify.RegIds = nil
+	return vo.send(ctx, notify, batch)
+}
+
+func (vo *VIVOPush) pushUniBatchCast(ctx context.Context, notify VIVONotifyPayload, batch *BatchResult) (err error) {
+	notify.Alias = ""
+	notify.RegId = ""
+	if len(notify.RegIds) == 0 && len(notify.Aliases) == 0 {
+		err = VIVOMissingBatchTargetErr
+		batch.Err = err
 		return
 	}
-	if resp.Code > 0 {
-		err = errors.New(resp.Message)
-		return
+	if len(batch.Tokens) == 0 {
+		batch.Tokens = append(append([]string{}, notify.Aliases...), notify.RegIds...)
 	}
-	taskId = resp.TaskId
-	return
+	return vo.send(ctx, notify, batch)
 }
 
-func (vo *VIVOPush) PushUniBatchCast() (err error) {
-	req, err := vo.buildReq(PRO_API_VIVO_SUBFIX_UNICASTBATCH)
+func (vo *VIVOPush) send(ctx context.Context, notify VIVONotifyPayload, batch *BatchResult) (err error) {
+	defer func() {
+		batch.done(err)
+	}()
+	req, err := vo.buildReq(ctx, batch.Endpoint)
 	if err != nil {
 		return
 	}
-	vo.Notify.Alias = ""
-	vo.Notify.RegId = ""
-	if len(vo.Notify.RegIds) == 0 || len(vo.Notify.Aliases) == 0 {
-		err = VIVOMissingBatchTargetErr
-		return
+	if len(notify.RequestId) == 0 {
+		notify.RequestId = vo.requestId()
 	}
-	var taskId string
-	if len(vo.Notify.TaskId) == 0 {
-		tmpAliases := vo.Notify.Aliases
-		tmpRegids := vo.Notify.RegIds
-		vo.Notify.Aliases = make([]string, 0, 0)
-		vo.Notify.RegIds = make([]string, 0, 0)
-		taskId, err = vo.SaveNotifyToVIVO()
-		if err != nil {
-			return
-		}
-		vo.Notify.TaskId = taskId
-		vo.Notify.RegIds = tmpRegids
-		vo.Notify.Aliases = tmpAliases
-	}
-	v, _ := json.Marshal(vo.Notify)
+	//retries reuse the requestId so vivo can drop duplicates
+	batch.RequestId = notify.RequestId
+	req.Idempotent = true
+	v, _ := json.Marshal(notify)
 	req.Body = v
-	body, _, _, err := req.doPushRequest()
+	body, err := req.send(ctx, batch)
 	if err != nil {
 		return
 	}
@@ -241,47 +294,90 @@ func (vo *VIVOPush) PushUniBatchCast() (err error) {
 	if err != nil {
 		return
 	}
-	if resp.Code > 0 {
-		err = errors.New(resp.Message)
-		return
+	batch.Code = strconv.Itoa(resp.Code)
+	if len(resp.RequestId) > 0 {
+		batch.RequestId = resp.RequestId
+	}
+	batch.TaskId = resp.TaskId
+	if len(batch.TaskId) == 0 && batch.Endpoint == PRO_API_VIVO_SUBFIX_UNICASTBATCH {
+		batch.TaskId = notify.TaskId
 	}
+	var rejected []string
+	for _, user := range resp.InvalidUsers {
+		rejected = append(rejected, user.UserId)
+	}
+	batch.settle(rejected)
 	return
 }
 
-func (vo *VIVOPush) push(title, content string, extras map[string]string, tokens []string) (err error) {
-	vo.Notify.Title = title
-	vo.Notify.Content = content
-	if len(extras) > 0 {
-		vo.Notify.Extras = extras
+func (vo *VIVOPush) applyMessage(msg *Message) (notify VIVONotifyPayload, warnings []string) {
+	w := &messageWarnings{provider: PlatformVIVO}
+	notify.Title = msg.Title
+	notify.Content = msg.Body
+	notify.Extras = msg.Extras
+	switch msg.ClickAction.Type {
+	case ClickActionUrl:
+		notify.SkipType = VIVOPushTypeUrl
+		notify.SkipContent = msg.ClickAction.Url
+	case ClickActionActivity:
+		notify.SkipType = VIVOPushTypeAppActivity
+		notify.SkipContent = msg.ClickAction.Activity
+	case ClickActionIntent:
+		notify.SkipType = VIVOPushTypeCustom
+		notify.SkipContent = msg.ClickAction.Intent
+	default:
+		notify.SkipType = VIVOPushTypeAppHome
+	}
+	notify.TimeToLive = msg.ttlSeconds()
+	notify.NotifyType = VIVOPushTypeSoundAndVibrate
+	if len(msg.Sound) > 0 {
+		w.add("custom sound %q is not supported, the default sound is used", msg.Sound)
 	}
+	w.unsupported("subtitle", len(msg.SubTitle) > 0)
+	w.unsupported("badge", msg.Badge > 0)
+	w.unsupported("channel id", len(msg.ChannelId) > 0)
+	w.unsupported("image", len(msg.ImageUrl) > 0)
+	w.unsupported("collapse key", len(msg.CollapseKey) > 0)
+	warnings = w.list
+	return
+}
+
+func (vo *VIVOPush) push(ctx context.Context, msg *Message, tokens []string) (result *PushResult, err error) {
+	result = newPushResult(PlatformVIVO)
+	notify, warnings := vo.applyMessage(msg)
+	result.Warnings = warnings
 	if len(tokens) == 0 {
-		_, err = vo.PushBroadCast()
+		batch := &BatchResult{Endpoint: PRO_API_VIVO_SUBFIX_BROADCAST}
+		vo.send(ctx, notify, batch)
+		result.add(batch)
 	} else if len(tokens) > 1 {
-		if len(tokens) > 1000 {
-			reqLengthMod := len(tokens) % 1000
-			reqLoop := len(tokens) / 1000
-			if reqLoop > 0 {
-				for i := 0; i < reqLoop; i++ {
-					start := i * 1000
-					tmpTokens := tokens[start : start+1000]
-					err = vo.buildBatchPush(tmpTokens)
-				}
-			}
-			if reqLengthMod > 0 {
-				leftTokens := tokens[reqLoop*1000:]
-				err = vo.buildBatchPush(leftTokens)
+		save := &BatchResult{Endpoint: PRO_API_VIVO_SUBFIX_SAVE}
+		vo.saveBatchNotify(ctx, notify, save)
+		result.add(save)
+		if save.Err != nil {
+			err = result.Err()
+			return
+		}
+		notify.TaskId = save.TaskId
+		for _, chunk := range splitTokens(tokens, 1000) {
+			if err = ctx.Err(); err != nil {
+				return
 			}
-		} else {
-			err = vo.buildBatchPush(tokens)
+			batch := &BatchResult{Endpoint: PRO_API_VIVO_SUBFIX_UNICASTBATCH, Tokens: chunk}
+			vo.buildBatchPush(ctx, notify, batch)
+			result.add(batch)
 		}
 	} else if len(tokens) == 1 {
-		vo.Notify.Alias = tokens[0]
-		_, err = vo.PushUniCast()
+		notify.Alias = tokens[0]
+		batch := &BatchResult{Endpoint: PRO_API_VIVO_SUBFIX_UNICAST}
+		vo.pushUniCast(ctx, notify, batch)
+		result.add(batch)
 	}
+	err = result.Err()
 	return
 }
 
-func (vo *VIVOPush) buildReq(queryPath string) (req *PushReq, err error) {
+func (vo *VIVOPush) newReq(queryPath string) (req *PushReq, err error) {
 	if vo.AppId == 0 {
 		err = VIVOMissingAppIdErr
 		return
@@ -294,36 +390,65 @@ func (vo *VIVOPush) buildReq(queryPath string) (req *PushReq, err error) {
 		err = VIVOMissingAppSecretKeyErr
 		return
 	}
-	if !vo.IgnoreCheckToken {
-		vo.checkTokenExpired()
-	}
-	if len(vo.Notify.RequestId) == 0 {
-		vo.requestId()
-	}
 	req = newPushReq()
+	vo.apply(req, PlatformVIVO, queryPath)
+	req.Check = vo.check
 	req.Headers = make(map[string]string, 0)
-	req.Headers["authToken"] = vo.AuthToken
 	req.Headers["Content-Type"] = "application/json"
 	req.Method = "POST"
-	req.Url = fmt.Sprintf("%s%s", PRO_API_VIVO_PREFIX, queryPath)
+	req.Url = endpointURL(vo.BaseURL, PRO_API_VIVO_PREFIX, queryPath)
+	return
+}
+
+func (vo *VIVOPush) buildReq(ctx context.Context, queryPath string) (req *PushReq, err error) {
+	req, err = vo.newReq(queryPath)
+	if err != nil {
+		return
+	}
+	req.Headers["authToken"], err = vo.checkTokenExpired(ctx)
+	req.Expired = vo.authExpired
+	req.Reauth = func(ctx context.Context) (err error) {
+		req.Headers["authToken"], err = vo.tokenProvider().Renew(ctx, req.Headers["authToken"])
+		return
+	}
 	return
 }
 
-func (vo *VIVOPush) buildBatchPush(tokens []string) (err error) {
-	vo.Notify.Aliases = tokens
-	return vo.PushUniBatchCast()
+func (vo *VIVOPush) buildBatchPush(ctx context.Context, notify VIVONotifyPayload, batch *BatchResult) (err error) {
+	notify.Aliases = batch.Tokens
+	return vo.pushUniBatchCast(ctx, notify, batch)
+}
+
+// authExpired reports result 10000, an authToken that failed authentication.
+func (vo *VIVOPush) authExpired(header http.Header, err error) bool {
+	return vendorCode(err) == "10000"
+}
+
+func (vo *VIVOPush) check(body []byte) (err error) {
+	resp := VIVOCommonResponse{}
+	if err = json.Unmarshal(body, &resp); err != nil {
+		return
+	}
+	if resp.Code != 0 {
+		err = newVendorErr(PlatformVIVO, strconv.Itoa(resp.Code), resp.Message)
+	}
+	return
 }
 
-func (vo *VIVOPush) sign() {
-	vo.Timestamp = vo.ms()
-	vo.Sign = vo.md5(fmt.Sprintf("%d%s%d%s", vo.AppId, vo.AppKey, vo.Timestamp, vo.AppSecretKey))
+func (vo *VIVOPush) sign() (auth VIVOAuthPayload) {
+	auth.AppId = vo.AppId
+	auth.AppKey = vo.AppKey
+	auth.Timestamp = vo.ms()
+	auth.Sign = vo.md5(fmt.Sprintf("%d%s%d%s", vo.AppId, vo.AppKey, auth.Timestamp, vo.AppSecretKey))
+	return
 }
 
-func (vo *VIVOPush) requestId() {
-	var b [12]byte
+func (vo *VIVOPush) requestId() string {
+	var b [16]byte
 	binary.LittleEndian.PutUint32(b[:], pid)
 	binary.LittleEndian.PutUint64(b[4:], uint64(time.Now().UnixNano()))
-	vo.Notify.RequestId = vo.md5(base64.URLEncoding.EncodeToString(b[:]))
+	binary.LittleEndian.PutUint32(b[12:], atomic.AddUint32(&requestSeq, 1))
+	return vo.md5(base64.URLEncoding.EncodeToString(b[:]))
 }
 
 func (vo *VIVOPush) ms() int64 {
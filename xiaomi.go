@@ -1,19 +1,27 @@
 package go_app_push
 
 import (
+	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"github.com/google/go-querystring/query"
 	"github.com/grokify/html-strip-tags-go"
 	"net/url"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type (
 	XMMsgType          uint32
 	XMNotifyEffectType uint32
 	XMNotifyType       int32
+	XMEnv              uint32
+)
+
+const (
+	XMEnvProduction XMEnv = 0
+	XMEnvSandbox    XMEnv = 1 //小米沙箱环境,仅支持iOS
 )
 
 const (
@@ -41,27 +49,43 @@ const (
 )
 
 const (
+	PRO_API_XM_PREFIX  string = "https://api.xmpush.xiaomi.com"
 	PRO_API_XM_ACCOUNT string = "https://api.xmpush.xiaomi.com/v2/message/user_account"
 	PRO_API_XM_ALIAS   string = "https://api.xmpush.xiaomi.com/v3/message/alias"
 	PRO_API_XM_TOPIC   string = "https://api.xmpush.xiaomi.com/v3/message/topic"
 	PRO_API_XM_MTOPIC  string = "https://api.xmpush.xiaomi.com/v3/message/multi_topic"
 	PRO_API_XM_ALL     string = "https://api.xmpush.xiaomi.com/v3/message/all"
+	PRO_API_XM_STATS   string = "https://api.xmpush.xiaomi.com/v1/stats/message/counters"
 )
 
 const (
+	TEST_IOS_XM_PREFIX  string = "https://sandbox.xmpush.xiaomi.com"
 	TEST_IOS_XM_REGID   string = "https://sandbox.xmpush.xiaomi.com/v2/message/regid"
 	TEST_IOS_XM_ALIAS   string = "https://sandbox.xmpush.xiaomi.com/v2/message/alias"
 	TEST_IOS_XM_ACCOUNT string = "https://sandbox.xmpush.xiaomi.com/v2/message/user_account"
 	TEST_IOS_XM_TOPIC   string = "https://sandbox.xmpush.xiaomi.com/v2/message/topic"
 	TEST_IOS_XM_MTOPIC  string = "https://sandbox.xmpush.xiaomi.com/v2/message/multi_topic"
 	TEST_IOS_XM_ALL     string = "https://sandbox.xmpush.xiaomi.com/v2/message/all"
+	TEST_IOS_XM_STATS   string = "https://sandbox.xmpush.xiaomi.com/v1/stats/message/counters"
 )
 
+// xmSandboxEndpoints maps production endpoints to their sandbox counterparts.
+var xmSandboxEndpoints = map[string]string{
+	PRO_API_XM_ACCOUNT: TEST_IOS_XM_ACCOUNT,
+	PRO_API_XM_ALIAS:   TEST_IOS_XM_ALIAS,
+	PRO_API_XM_TOPIC:   TEST_IOS_XM_TOPIC,
+	PRO_API_XM_MTOPIC:  TEST_IOS_XM_MTOPIC,
+	PRO_API_XM_ALL:     TEST_IOS_XM_ALL,
+	PRO_API_XM_STATS:   TEST_IOS_XM_STATS,
+}
+
 type XiaoMiPush struct {
-	AppSecret  string     `url:"-" json:"-"`
-	AppPkgName string     `url:"-" json:"app_pkg_name"`
-	DeviceType DeviceType `url:"-" json:"-"`
-	Payload    XMPayload  `url:"-" json:"-"`
+	AppSecret     string     `url:"-" json:"-"`
+	AppPkgName    string     `url:"-" json:"app_pkg_name"`
+	DeviceType    DeviceType `url:"-" json:"-"`
+	Env           XMEnv      `url:"-" json:"-"`
+	BaseURL       string     `url:"-" json:"-"` // replaces PRO_API_XM_PREFIX or TEST_IOS_XM_PREFIX when set
+	ClientOptions `url:"-" json:"-"`
 }
 
 type XMPayload struct {
@@ -103,6 +127,7 @@ type AndroidExtra struct {
 	AppVersion       string             `url:"extra.app_version,omitempty" json:"app_version,omitempty"`
 	AppVersionNotIn  string             `url:"extra.app_version_not_in,omitempty" json:"app_version_not_in,omitempty"`
 	Connpt           string             `url:"extra.connpt,omitempty" json:"connpt,omitempty"`
+	ChannelId        string             `url:"extra.channel_id,omitempty" json:"channel_id,omitempty"`
 }
 
 type IOSExtra struct {
@@ -112,6 +137,23 @@ type IOSExtra struct {
 	Category int    `url:"extra.category,omitempty" json:"category,omitempty"`
 }
 
+// xmErrCategories maps Xiaomi result codes to error categories.
+var xmErrCategories = map[string]ErrorCategory{
+	"10001": ErrorCategoryTransient,      //系统错误
+	"10002": ErrorCategoryTransient,      //服务暂停
+	"10003": ErrorCategoryTransient,      //远程服务错误
+	"10014": ErrorCategoryAuthFailed,     //应用的接口访问权限受限
+	"10016": ErrorCategoryPayloadInvalid, //缺失必选参数
+	"10017": ErrorCategoryPayloadInvalid, //参数值非法
+	"10018": ErrorCategoryPayloadInvalid, //请求长度超过限制
+	"10022": ErrorCategoryRateLimited,    //IP请求频次超过上限
+	"10023": ErrorCategoryRateLimited,    //用户请求频次超过上限
+	"21301": ErrorCategoryAuthFailed,     //认证失败
+	"22001": ErrorCategoryAuthFailed,     //应用不存在
+	"22002": ErrorCategoryAuthFailed,     //应用已被注销
+	"22003": ErrorCategoryAuthFailed,     //应用没有权限
+}
+
 type XMCommonResp struct {
 	Status string            `json:"result"`
 	Detail string            `json:"info"`
@@ -142,40 +184,73 @@ func (xm *XiaoMiPush) buildReq(url string) (req *PushReq, err error) {
 		return
 	}
 	req = newPushReq()
+	xm.apply(req, PlatformXIAOMI, url)
+	req.Check = xm.check
 	req.Headers = make(map[string]string, 0)
 	req.Headers["Authorization"] = fmt.Sprintf("key=%s", xm.AppSecret)
 	req.Method = "POST"
-	req.Url = url
+	req.Url = endpointURL(xm.BaseURL, PRO_API_XM_PREFIX, url)
+	if sandbox, ok := xmSandboxEndpoints[url]; ok && xm.Env == XMEnvSandbox {
+		req.Url = endpointURL(xm.BaseURL, TEST_IOS_XM_PREFIX, sandbox)
+	}
+	return
+}
+
+func (xm *XiaoMiPush) PushBroadCast(payload XMPayload) (id string, err error) {
+	return xm.PushBroadCastWithContext(context.Background(), payload)
+}
+
+func (xm *XiaoMiPush) PushBroadCastWithContext(ctx context.Context, payload XMPayload) (id string, err error) {
+	batch := &BatchResult{Endpoint: PRO_API_XM_ALL}
+	err = xm.sendBatch(ctx, payload, batch)
+	id = batch.MessageId
+	return
+}
+
+func (xm *XiaoMiPush) PushUniBatchCast(payload XMPayload) (id string, err error) {
+	return xm.PushUniBatchCastWithContext(context.Background(), payload)
+}
+
+func (xm *XiaoMiPush) PushUniBatchCastWithContext(ctx context.Context, payload XMPayload) (id string, err error) {
+	batch := &BatchResult{Endpoint: PRO_API_XM_ALIAS}
+	if len(payload.Alias) > 0 {
+		batch.Tokens = strings.Split(payload.Alias, ",")
+	}
+	err = xm.sendBatch(ctx, payload, batch)
+	id = batch.MessageId
 	return
 }
 
-func (xm *XiaoMiPush) PushBroadCast() (id string, err error) {
-	req, err := xm.buildReq(PRO_API_XM_ALL)
+func (xm *XiaoMiPush) sendBatch(ctx context.Context, payload XMPayload, batch *BatchResult) (err error) {
+	defer func() {
+		batch.done(err)
+	}()
+	req, err := xm.buildReq(batch.Endpoint)
 	if err != nil {
 		return
 	}
 	var postBodyStr = ""
-	v, _ := query.Values(xm.Payload)
+	v, _ := query.Values(payload)
 	postBodyStr = v.Encode()
-	if len(xm.Payload.ExtraCustom) > 0 {
+	if len(payload.ExtraCustom) > 0 {
 		vExtraCustom := url.Values{}
-		for k, v := range xm.Payload.ExtraCustom {
+		for k, v := range payload.ExtraCustom {
 			vExtraCustom.Add(k, v)
 		}
 		postBodyStr = fmt.Sprintf("%s&%s", postBodyStr, vExtraCustom.Encode())
 	}
-	if xm.Payload.Extra != nil {
-		if androidExtra, ok := xm.Payload.Extra.(AndroidExtra); ok {
+	if payload.Extra != nil {
+		if androidExtra, ok := payload.Extra.(AndroidExtra); ok {
 			androidExtraV, _ := query.Values(androidExtra)
 			postBodyStr = fmt.Sprintf("%s&%s", postBodyStr, androidExtraV.Encode())
 		}
-		if iosExtra, ok := xm.Payload.Extra.(IOSExtra); ok {
+		if iosExtra, ok := payload.Extra.(IOSExtra); ok {
 			iosExtraV, _ := query.Values(iosExtra)
 			postBodyStr = fmt.Sprintf("%s&%s", postBodyStr, iosExtraV.Encode())
 		}
 	}
 	req.Body = []byte(postBodyStr)
-	body, _, _, err := req.doPushRequest()
+	body, err := req.send(ctx, batch)
 	if err != nil {
 		return
 	}
@@ -184,104 +259,155 @@ func (xm *XiaoMiPush) PushBroadCast() (id string, err error) {
 	if err != nil {
 		return
 	}
-	if resp.Code > 0 {
-		err = errors.New(resp.Msg)
-		return
+	batch.Code = strconv.Itoa(resp.Code)
+	batch.MessageId = resp.Data["id"]
+	var rejected []string
+	for _, key := range []string{"bad_regids", "bad_alias"} {
+		if len(resp.Data[key]) > 0 {
+			rejected = append(rejected, strings.Split(resp.Data[key], ",")...)
+		}
 	}
-	xm.Payload.Extra = resp.Data["id"]
+	batch.settle(rejected)
 	return
 }
 
-func (xm *XiaoMiPush) PushUniBatchCast() (id string, err error) {
-	req, err := xm.buildReq(PRO_API_XM_ALIAS)
-	if err != nil {
+func (xm *XiaoMiPush) check(body []byte) (err error) {
+	resp := XMCommonResp{}
+	if err = json.Unmarshal(body, &resp); err != nil {
 		return
 	}
-	var postBodyStr = ""
-	v, _ := query.Values(xm.Payload)
-	postBodyStr = v.Encode()
-	if len(xm.Payload.ExtraCustom) > 0 {
-		vExtraCustom := url.Values{}
-		for k, v := range xm.Payload.ExtraCustom {
-			vExtraCustom.Add(k, v)
-		}
-		postBodyStr = fmt.Sprintf("%s&%s", postBodyStr, vExtraCustom.Encode())
-	}
-	if xm.Payload.Extra != nil {
-		if androidExtra, ok := xm.Payload.Extra.(AndroidExtra); ok {
-			androidExtraV, _ := query.Values(androidExtra)
-			postBodyStr = fmt.Sprintf("%s&%s", postBodyStr, androidExtraV.Encode())
-		}
-		if iosExtra, ok := xm.Payload.Extra.(IOSExtra); ok {
-			iosExtraV, _ := query.Values(iosExtra)
-			postBodyStr = fmt.Sprintf("%s&%s", postBodyStr, iosExtraV.Encode())
-		}
-	}
-	req.Body = []byte(postBodyStr)
-	body, _, _, err := req.doPushRequest()
-	if err != nil {
-		return
+	if resp.Code > 0 {
+		err = newVendorErr(PlatformXIAOMI, strconv.Itoa(resp.Code), resp.Msg)
 	}
-	resp := XMCommonResp{}
-	err = json.Unmarshal(body, &resp)
+	return
+}
+
+// Verify reads today's message counters, a read-only call that checks the app
+// secret and the package name.
+func (xm *XiaoMiPush) Verify(ctx context.Context) (report *VerifyReport, err error) {
+	report = newVerifyReport(PlatformXIAOMI, PRO_API_XM_STATS)
+	report.PackageChecked = true
+	req, err := xm.buildReq(PRO_API_XM_STATS)
 	if err != nil {
+		report.Err = err
 		return
 	}
-	if resp.Code > 0 {
-		err = errors.New(resp.Msg)
+	today := time.Now().Format("20060102")
+	v := url.Values{}
+	v.Set("start_date", today)
+	v.Set("end_date", today)
+	v.Set("restricted_package_name", xm.AppPkgName)
+	req.Method = "GET"
+	req.Url = fmt.Sprintf("%s?%s", req.Url, v.Encode())
+	req.Check = func(body []byte) (err error) {
+		resp := XMResp{}
+		if err = json.Unmarshal(body, &resp); err != nil {
+			return
+		}
+		if resp.Code > 0 {
+			err = newVendorErr(PlatformXIAOMI, strconv.Itoa(resp.Code), resp.Msg)
+		}
 		return
 	}
-	xm.Payload.Extra = resp.Data["id"]
+	start := time.Now()
+	_, _, header, err := req.doPushRequest(ctx)
+	err = report.observe(start, header, AccessToken{}, err)
 	return
 }
 
-func (xm *XiaoMiPush) push(title, content string, extras map[string]string, tokens []string) (err error) {
+func (xm *XiaoMiPush) applyMessage(msg *Message) (payload XMPayload, warnings []string) {
+	w := &messageWarnings{provider: PlatformXIAOMI}
 	if xm.DeviceType == DeviceANDROID {
-		if xm.Payload.Extra == nil {
-			xm.Payload.Extra = AndroidExtra{}
-		}
-	} else if xm.DeviceType == DeviceIOS {
-		if xm.Payload.Extra == nil {
-			xm.Payload.Extra = IOSExtra{}
-		}
-	}
-	if len(extras) > 0 {
-		if androidExtra, ok := xm.Payload.Extra.(AndroidExtra); ok && xm.DeviceType == DeviceANDROID {
+		androidExtra := AndroidExtra{}
+		if len(msg.Extras) > 0 {
 			androidExtra.NotifyForeground = "1"
 			//androidExtra.NotifyEffect = XMNotifyEffectTypeCustom
 			androidExtra.FlowControl = 0
-			xm.Payload.Extra = androidExtra
 		}
-		if iosExtra, ok := xm.Payload.Extra.(IOSExtra); ok && xm.DeviceType == DeviceIOS {
-			extraBytArr, _ := json.Marshal(extras)
+		switch msg.ClickAction.Type {
+		case ClickActionUrl:
+			androidExtra.NotifyEffect = XMNotifyEffectTypeWeb
+			androidExtra.WebUri = msg.ClickAction.Url
+		case ClickActionActivity:
+			androidExtra.NotifyEffect = XMNotifyEffectTypeAppActivity
+			androidExtra.IntentUri = msg.ClickAction.Activity
+		case ClickActionIntent:
+			androidExtra.NotifyEffect = XMNotifyEffectTypeAppActivity
+			androidExtra.IntentUri = msg.ClickAction.Intent
+		}
+		androidExtra.SoundUri = msg.Sound
+		androidExtra.ChannelId = msg.ChannelId
+		w.unsupported("badge", msg.Badge > 0)
+		payload.Extra = androidExtra
+	} else if xm.DeviceType == DeviceIOS {
+		iosExtra := IOSExtra{}
+		if len(msg.Extras) > 0 {
+			extraBytArr, _ := json.Marshal(msg.Extras)
 			iosExtra.Custom = string(extraBytArr)
 			iosExtra.Badge = 1
-			xm.Payload.Extra = iosExtra
 		}
+		if msg.Badge > 0 {
+			iosExtra.Badge = msg.Badge
+		}
+		iosExtra.SoundUrl = msg.Sound
+		w.unsupported("click action", msg.ClickAction.Type != ClickActionOpenApp)
+		w.unsupported("channel id", len(msg.ChannelId) > 0)
+		payload.Extra = iosExtra
+	} else {
+		w.unsupported("click action", msg.ClickAction.Type != ClickActionOpenApp)
+		w.unsupported("sound", len(msg.Sound) > 0)
+		w.unsupported("badge", msg.Badge > 0)
+		w.unsupported("channel id", len(msg.ChannelId) > 0)
+	}
+	if len(msg.Extras) > 0 {
 		tmpExtra := make(map[string]string, 0)
-		for k, v := range extras {
+		for k, v := range msg.Extras {
 			tmpExtra[fmt.Sprintf("%s%s", XMExtraPrefix, k)] = v
 		}
-		xm.Payload.ExtraCustom = tmpExtra
+		payload.ExtraCustom = tmpExtra
 	}
+	w.unsupported("subtitle", len(msg.SubTitle) > 0)
+	w.unsupported("image", len(msg.ImageUrl) > 0)
 	var desStr string
-	des := strip.StripTags(content)
+	des := strip.StripTags(msg.Body)
 	if len([]rune(des)) > 25 {
 		desStr = string([]rune(des)[0:25])
 	} else {
 		desStr = des
 	}
-	xm.Payload.Title = title
-	xm.Payload.Description = desStr
-	xm.Payload.Content = content
-	xm.Payload.NotifyType = XMNotifyTypeAll
-	xm.Payload.MsgType = XMMsgTypeSystemNotify
-	xm.Payload.AppPkgName = xm.AppPkgName
+	payload.Title = msg.Title
+	payload.Description = desStr
+	payload.Content = msg.Body
+	payload.NotifyType = XMNotifyTypeAll
+	payload.MsgType = XMMsgTypeSystemNotify
+	payload.AppPkgName = xm.AppPkgName
+	payload.TimeToLive = int64(msg.TTL / time.Millisecond)
+	if len(msg.CollapseKey) > 0 {
+		payload.NotifyId = msg.collapseId()
+	}
+	warnings = w.list
+	return
+}
+
+func (xm *XiaoMiPush) push(ctx context.Context, msg *Message, tokens []string) (result *PushResult, err error) {
+	result = newPushResult(PlatformXIAOMI)
+	payload, warnings := xm.applyMessage(msg)
+	result.Warnings = warnings
 	if len(tokens) == 0 {
-		_, err = xm.PushBroadCast()
+		batch := &BatchResult{Endpoint: PRO_API_XM_ALL}
+		xm.sendBatch(ctx, payload, batch)
+		result.add(batch)
 	} else {
-		xm.Payload.Alias = strings.Join(tokens, ",")
-		_, err = xm.PushUniBatchCast()
+		for _, chunk := range splitTokens(tokens, 1000) {
+			if err = ctx.Err(); err != nil {
+				return
+			}
+			payload.Alias = strings.Join(chunk, ",")
+			batch := &BatchResult{Endpoint: PRO_API_XM_ALIAS, Tokens: chunk}
+			xm.sendBatch(ctx, payload, batch)
+			result.add(batch)
+		}
 	}
+	err = result.Err()
 	return
 }
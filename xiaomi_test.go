@@ -0,0 +1,20 @@
+package go_app_push
+
+import (
+	"strings"
+	"testing"
+)
+
+// Every endpoint, Verify's included, must stay on the sandbox host.
+func TestXMSandboxEndpoints(t *testing.T) {
+	xm := &XiaoMiPush{AppSecret: "s", AppPkgName: "p", Env: XMEnvSandbox}
+	for _, endpoint := range []string{PRO_API_XM_ACCOUNT, PRO_API_XM_ALIAS, PRO_API_XM_TOPIC, PRO_API_XM_MTOPIC, PRO_API_XM_ALL, PRO_API_XM_STATS} {
+		req, err := xm.buildReq(endpoint)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(req.Url, TEST_IOS_XM_PREFIX+"/") {
+			t.Errorf("%s: url = %s", endpoint, req.Url)
+		}
+	}
+}